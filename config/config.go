@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/itzg/go-flagsfiller"
 	toml "github.com/knadh/koanf/parsers/toml/v2"
@@ -15,11 +16,19 @@ import (
 type Config struct {
 	BindAddress string `flag:"bind_address"`
 	Port        string `flag:"listen_port"`
+	UDPPort     string `flag:"udp_port"`
 	BaseURL     string `flag:"url_base"`
 	// Deprecated
 	ProxyProtocolPort       string   `flag:"proxyprotocol_port"`
 	EnableProxyprotocol     bool     `flag:"enable_proxyprotocol"`
 	ProxyprotocolAllowedIPs []string `flag:"proxyprotocol_allowed_ips"`
+	TrustedProxies          []string `flag:"trusted_proxies"`
+	RealIPHeader            string   `flag:"real_ip_header"`
+
+	TCPCongestionControl         string   `flag:"tcp_congestion_control"`
+	TCPAllowedCongestionControls []string `flag:"tcp_allowed_congestion_controls"`
+	TCPSendBuffer                int      `flag:"tcp_send_buffer"`
+	TCPRecvBuffer                int      `flag:"tcp_recv_buffer"`
 
 	ServerLat    float64 `flag:"server_lat"`
 	ServerLng    float64 `flag:"server_lng"`
@@ -28,8 +37,44 @@ type Config struct {
 	StatsPassword string `flag:"statistics_password"`
 	RedactIP      bool   `flag:"redact_ip_addresses"`
 
+	TelemetryVerification          string        `flag:"telemetry_verification"`
+	TelemetryVerificationTolerance float64       `flag:"telemetry_verification_tolerance"`
+	TelemetryRequireToken          bool          `flag:"telemetry_require_token"`
+	TelemetryTokenSecret           string        `flag:"telemetry_token_secret"`
+	TelemetryTokenTTL              time.Duration `flag:"telemetry_token_ttl"`
+
 	AssetsPath string `flag:"assets_path"`
 
+	RateLimitRequests   float64 `flag:"rate_limit_requests"`
+	RateLimitBurst      int     `flag:"rate_limit_burst"`
+	RateLimitStreams    int     `flag:"rate_limit_streams"`
+	RateLimitIPv4Prefix int     `flag:"rate_limit_ipv4_prefix"`
+	RateLimitIPv6Prefix int     `flag:"rate_limit_ipv6_prefix"`
+
+	PowDifficulty int           `flag:"pow_difficulty"`
+	PowThreshold  string        `flag:"pow_threshold"`
+	PowSecret     string        `flag:"pow_secret"`
+	PowTTL        time.Duration `flag:"pow_ttl"`
+
+	MaxConcurrentTests int           `flag:"max_concurrent_tests"`
+	TestIdleTimeout    time.Duration `flag:"test_idle_timeout"`
+
+	QuotaDownloadPerIP string        `flag:"quota_download_per_ip"`
+	QuotaUploadPerIP   string        `flag:"quota_upload_per_ip"`
+	QuotaDownload      string        `flag:"quota_download"`
+	QuotaUpload        string        `flag:"quota_upload"`
+	QuotaFlushInterval time.Duration `flag:"quota_flush_interval"`
+
+	ChunkSize           string        `flag:"chunk_size"`
+	MaxDownloadSize     string        `flag:"max_download_size"`
+	MaxUploadSize       string        `flag:"max_upload_size"`
+	MaxDownloadDuration time.Duration `flag:"max_download_duration"`
+	UniquePayload       bool          `flag:"unique_payload"`
+	TestFiles           []string      `flag:"test_files"`
+
+	EnableShaping   bool              `flag:"enable_shaping"`
+	ShapingProfiles map[string]string `flag:"shaping_profiles"`
+
 	DatabaseType     string `flag:"database_type"`
 	DatabaseHostname string `flag:"database_hostname"`
 	DatabaseName     string `flag:"database_name"`
@@ -42,18 +87,39 @@ type Config struct {
 	EnableTLS   bool   `flag:"enable_tls"`
 	TLSCertFile string `flag:"tls_cert_file"`
 	TLSKeyFile  string `flag:"tls_key_file"`
+
+	IperfPort        string        `flag:"iperf_port"`
+	IperfMaxDuration time.Duration `flag:"iperf_max_duration"`
+
+	EnableHTTP3        bool   `flag:"enable_http3"`
+	HTTP3Port          string `flag:"http3_port"`
+	EnableWebTransport bool   `flag:"enable_webtransport"`
 }
 
 var (
 	config *Config = &Config{
-		Port:                    "8989",
-		EnableProxyprotocol:     false,
-		ProxyprotocolAllowedIPs: []string{"127.0.0.1/32", "::1/128"},
-		StatsPassword:           "PASSWORD",
-		DatabaseType:            "postgresql",
-		DatabaseHostname:        "localhost",
-		DatabaseName:            "speedtest",
-		DatabaseUsername:        "postgres",
+		Port:                           "8989",
+		EnableProxyprotocol:            false,
+		ProxyprotocolAllowedIPs:        []string{"127.0.0.1/32", "::1/128"},
+		TrustedProxies:                 []string{"127.0.0.1/32", "::1/128"},
+		StatsPassword:                  "PASSWORD",
+		DatabaseType:                   "postgresql",
+		DatabaseHostname:               "localhost",
+		DatabaseName:                   "speedtest",
+		DatabaseUsername:               "postgres",
+		MaxDownloadDuration:            time.Minute,
+		IperfMaxDuration:               time.Minute,
+		ChunkSize:                      "1MB",
+		MaxDownloadSize:                "1GB",
+		TelemetryVerification:          "off",
+		TelemetryVerificationTolerance: 0.5,
+		RateLimitBurst:                 20,
+		RateLimitIPv4Prefix:            32,
+		RateLimitIPv6Prefix:            64,
+		PowThreshold:                   "100MB",
+		PowTTL:                         5 * time.Minute,
+		TestIdleTimeout:                10 * time.Second,
+		QuotaFlushInterval:             time.Minute,
 	}
 )
 
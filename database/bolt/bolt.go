@@ -1,6 +1,7 @@
 package bolt
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,7 +13,8 @@ import (
 )
 
 const (
-	bucketName = `speedtest`
+	bucketName      = `speedtest`
+	quotaBucketName = `quota`
 )
 
 type Bolt struct {
@@ -80,3 +82,55 @@ func (p *Bolt) FetchLast100() ([]schema.TelemetryData, error) {
 	})
 	return records, err
 }
+
+// quotaKey sorts the counters of a day together, global ones first
+func quotaKey(day time.Time, ip string) []byte {
+	return []byte(day.UTC().Format(time.DateOnly) + "/" + ip)
+}
+
+func (p *Bolt) AddQuotaUsage(usage []schema.QuotaUsage) error {
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(quotaBucketName))
+		if err != nil {
+			return err
+		}
+		for _, u := range usage {
+			key := quotaKey(u.Day, u.IPAddress)
+			var cur schema.QuotaUsage
+			if b := bucket.Get(key); b != nil {
+				if err := json.Unmarshal(b, &cur); err != nil {
+					return err
+				}
+			}
+			cur.Day, cur.IPAddress = u.Day, u.IPAddress
+			cur.Egress += u.Egress
+			cur.Ingress += u.Ingress
+			b, _ := json.Marshal(cur)
+			if err := bucket.Put(key, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *Bolt) FetchQuotaUsage(day time.Time) ([]schema.QuotaUsage, error) {
+	var usage []schema.QuotaUsage
+	err := p.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(quotaBucketName))
+		if bucket == nil {
+			return nil
+		}
+		prefix := quotaKey(day, "")
+		cursor := bucket.Cursor()
+		for k, b := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, b = cursor.Next() {
+			var u schema.QuotaUsage
+			if err := json.Unmarshal(b, &u); err != nil {
+				return err
+			}
+			usage = append(usage, u)
+		}
+		return nil
+	})
+	return usage, err
+}
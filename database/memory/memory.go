@@ -16,6 +16,9 @@ const (
 type Memory struct {
 	lock    sync.RWMutex
 	records []schema.TelemetryData
+	// quota counters of the latest day only
+	quotaDay time.Time
+	quota    map[string]schema.QuotaUsage
 }
 
 func Open(_ schema.Config) (schema.DataAccess, error) {
@@ -49,3 +52,35 @@ func (mem *Memory) FetchLast100() ([]schema.TelemetryData, error) {
 	defer mem.lock.RUnlock()
 	return mem.records, nil
 }
+
+func (mem *Memory) AddQuotaUsage(usage []schema.QuotaUsage) error {
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	for _, u := range usage {
+		if u.Day.Before(mem.quotaDay) {
+			continue
+		}
+		if u.Day.After(mem.quotaDay) {
+			mem.quotaDay = u.Day
+			mem.quota = make(map[string]schema.QuotaUsage)
+		}
+		cur := mem.quota[u.IPAddress]
+		cur.Day, cur.IPAddress = u.Day, u.IPAddress
+		cur.Egress += u.Egress
+		cur.Ingress += u.Ingress
+		mem.quota[u.IPAddress] = cur
+	}
+	return nil
+}
+
+func (mem *Memory) FetchQuotaUsage(day time.Time) ([]schema.QuotaUsage, error) {
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+	var usage []schema.QuotaUsage
+	if day.Equal(mem.quotaDay) {
+		for _, u := range mem.quota {
+			usage = append(usage, u)
+		}
+	}
+	return usage, nil
+}
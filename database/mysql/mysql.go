@@ -3,6 +3,7 @@ package mysql
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/librespeed/speedtest/database/schema"
 
@@ -10,7 +11,18 @@ import (
 )
 
 const (
+	// columns are listed explicitly, so that tables migrated with ALTER TABLE ... ADD COLUMN scan the same way as new ones
+	selectColumns = `timestamp, ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, COALESCE(server_info, '')`
+
 	connectionStringTemplate = `%s:%s@tcp(%s)/%s?parseTime=true`
+
+	createQuotaTable = `CREATE TABLE IF NOT EXISTS speedtest_quota (
+  day date NOT NULL,
+  ip varchar(45) NOT NULL,
+  egress bigint NOT NULL DEFAULT 0,
+  ingress bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (day, ip)
+)`
 )
 
 type MySQL struct {
@@ -27,21 +39,40 @@ func Open(c schema.Config) (schema.DataAccess, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := migrate(conn); err != nil {
+		return nil, fmt.Errorf("cannot migrate MySQL database: %w", err)
+	}
 	return &MySQL{db: conn}, nil
 }
 
+// migrate brings databases created from older versions of telemetry_mysql.sql up to date
+func migrate(db *sql.DB) error {
+	var n int
+	row := db.QueryRow(`SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'speedtest_users' AND column_name = 'server_info'`)
+	if err := row.Scan(&n); err != nil {
+		return err
+	}
+	// MySQL has no ADD COLUMN IF NOT EXISTS
+	if n == 0 {
+		if _, err := db.Exec(`ALTER TABLE speedtest_users ADD COLUMN server_info text`); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(createQuotaTable)
+	return err
+}
+
 func (p *MySQL) Insert(data *schema.TelemetryData) error {
-	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
-	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID)
+	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_info) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID, data.ServerInfo)
 	return err
 }
 
 func (p *MySQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 	var record schema.TelemetryData
-	row := p.db.QueryRow(`SELECT * FROM speedtest_users WHERE uuid = ?`, uuid)
+	row := p.db.QueryRow(`SELECT `+selectColumns+` FROM speedtest_users WHERE uuid = ?`, uuid)
 	if row != nil {
-		var id string
-		if err := row.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+		if err := row.Scan(&record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID, &record.ServerInfo); err != nil {
 			return nil, err
 		}
 	}
@@ -50,16 +81,14 @@ func (p *MySQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 
 func (p *MySQL) FetchLast100() ([]schema.TelemetryData, error) {
 	var records []schema.TelemetryData
-	rows, err := p.db.Query(`SELECT * FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
+	rows, err := p.db.Query(`SELECT ` + selectColumns + ` FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
 	if err != nil {
 		return nil, err
 	}
 	if rows != nil {
-		var id string
-
 		for rows.Next() {
 			var record schema.TelemetryData
-			if err := rows.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+			if err := rows.Scan(&record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID, &record.ServerInfo); err != nil {
 				return nil, err
 			}
 			records = append(records, record)
@@ -67,3 +96,36 @@ func (p *MySQL) FetchLast100() ([]schema.TelemetryData, error) {
 	}
 	return records, nil
 }
+
+func (p *MySQL) AddQuotaUsage(usage []schema.QuotaUsage) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := `INSERT INTO speedtest_quota (day, ip, egress, ingress) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE egress = egress + VALUES(egress), ingress = ingress + VALUES(ingress);`
+	for _, u := range usage {
+		// a time.Time would be formatted in the connection's loc, which needn't be UTC
+		if _, err := tx.Exec(stmt, u.Day.UTC().Format(time.DateOnly), u.IPAddress, u.Egress, u.Ingress); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *MySQL) FetchQuotaUsage(day time.Time) ([]schema.QuotaUsage, error) {
+	var usage []schema.QuotaUsage
+	rows, err := p.db.Query(`SELECT ip, egress, ingress FROM speedtest_quota WHERE day = ?`, day.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := schema.QuotaUsage{Day: day}
+		if err := rows.Scan(&u.IPAddress, &u.Egress, &u.Ingress); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -32,7 +32,20 @@ CREATE TABLE `speedtest_users` (
   `ping` text,
   `jitter` text,
   `log` longtext,
-  `uuid` text
+  `uuid` text,
+  `server_info` text
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+--
+-- Table structure for table `speedtest_quota`
+--
+
+CREATE TABLE `speedtest_quota` (
+  `day` date NOT NULL,
+  `ip` varchar(45) NOT NULL,
+  `egress` bigint NOT NULL DEFAULT 0,
+  `ingress` bigint NOT NULL DEFAULT 0,
+  PRIMARY KEY (`day`, `ip`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
 --
@@ -1,6 +1,8 @@
 package none
 
 import (
+	"time"
+
 	"github.com/librespeed/speedtest/database/schema"
 )
 
@@ -21,3 +23,11 @@ func (n *None) FetchByUUID(_ string) (*schema.TelemetryData, error) {
 func (n *None) FetchLast100() ([]schema.TelemetryData, error) {
 	return []schema.TelemetryData{}, nil
 }
+
+func (n *None) AddQuotaUsage(_ []schema.QuotaUsage) error {
+	return nil
+}
+
+func (n *None) FetchQuotaUsage(_ time.Time) ([]schema.QuotaUsage, error) {
+	return []schema.QuotaUsage{}, nil
+}
@@ -3,6 +3,7 @@ package postgresql
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/librespeed/speedtest/database/schema"
 
@@ -10,7 +11,18 @@ import (
 )
 
 const (
+	// columns are listed explicitly, so that tables migrated with ALTER TABLE ... ADD COLUMN scan the same way as new ones
+	selectColumns = `"timestamp", ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, COALESCE(server_info, '')`
+
 	connectionStringTemplate = `postgres://%s:%s@%s/%s?sslmode=disable`
+
+	createQuotaTable = `CREATE TABLE IF NOT EXISTS speedtest_quota (
+    day date NOT NULL,
+    ip text NOT NULL,
+    egress bigint DEFAULT 0 NOT NULL,
+    ingress bigint DEFAULT 0 NOT NULL,
+    PRIMARY KEY (day, ip)
+)`
 )
 
 type PostgreSQL struct {
@@ -27,21 +39,32 @@ func Open(c schema.Config) (schema.DataAccess, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := migrate(conn); err != nil {
+		return nil, fmt.Errorf("cannot migrate PostgreSQL database: %w", err)
+	}
 	return &PostgreSQL{db: conn}, nil
 }
 
+// migrate brings databases created from older versions of telemetry_postgresql.sql up to date
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`ALTER TABLE speedtest_users ADD COLUMN IF NOT EXISTS server_info text`); err != nil {
+		return err
+	}
+	_, err := db.Exec(createQuotaTable)
+	return err
+}
+
 func (p *PostgreSQL) Insert(data *schema.TelemetryData) error {
-	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id;`
-	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID)
+	stmt := `INSERT INTO speedtest_users (ip, ispinfo, extra, ua, lang, dl, ul, ping, jitter, log, uuid, server_info) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id;`
+	_, err := p.db.Exec(stmt, data.IPAddress, data.ISPInfo, data.Extra, data.UserAgent, data.Language, data.Download, data.Upload, data.Ping, data.Jitter, data.Log, data.UUID, data.ServerInfo)
 	return err
 }
 
 func (p *PostgreSQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 	var record schema.TelemetryData
-	row := p.db.QueryRow(`SELECT * FROM speedtest_users WHERE uuid = $1`, uuid)
+	row := p.db.QueryRow(`SELECT `+selectColumns+` FROM speedtest_users WHERE uuid = $1`, uuid)
 	if row != nil {
-		var id string
-		if err := row.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+		if err := row.Scan(&record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID, &record.ServerInfo); err != nil {
 			return nil, err
 		}
 	}
@@ -50,16 +73,14 @@ func (p *PostgreSQL) FetchByUUID(uuid string) (*schema.TelemetryData, error) {
 
 func (p *PostgreSQL) FetchLast100() ([]schema.TelemetryData, error) {
 	var records []schema.TelemetryData
-	rows, err := p.db.Query(`SELECT * FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
+	rows, err := p.db.Query(`SELECT ` + selectColumns + ` FROM speedtest_users ORDER BY "timestamp" DESC LIMIT 100;`)
 	if err != nil {
 		return nil, err
 	}
 	if rows != nil {
-		var id string
-
 		for rows.Next() {
 			var record schema.TelemetryData
-			if err := rows.Scan(&id, &record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID); err != nil {
+			if err := rows.Scan(&record.Timestamp, &record.IPAddress, &record.ISPInfo, &record.Extra, &record.UserAgent, &record.Language, &record.Download, &record.Upload, &record.Ping, &record.Jitter, &record.Log, &record.UUID, &record.ServerInfo); err != nil {
 				return nil, err
 			}
 			records = append(records, record)
@@ -67,3 +88,36 @@ func (p *PostgreSQL) FetchLast100() ([]schema.TelemetryData, error) {
 	}
 	return records, nil
 }
+
+func (p *PostgreSQL) AddQuotaUsage(usage []schema.QuotaUsage) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := `INSERT INTO speedtest_quota (day, ip, egress, ingress) VALUES ($1, $2, $3, $4) ON CONFLICT (day, ip) DO UPDATE SET egress = speedtest_quota.egress + EXCLUDED.egress, ingress = speedtest_quota.ingress + EXCLUDED.ingress;`
+	for _, u := range usage {
+		// a time.Time is sent as timestamptz, and converted to a date in the session's TimeZone
+		if _, err := tx.Exec(stmt, u.Day.UTC().Format(time.DateOnly), u.IPAddress, u.Egress, u.Ingress); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgreSQL) FetchQuotaUsage(day time.Time) ([]schema.QuotaUsage, error) {
+	var usage []schema.QuotaUsage
+	rows, err := p.db.Query(`SELECT ip, egress, ingress FROM speedtest_quota WHERE day = $1`, day.UTC().Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := schema.QuotaUsage{Day: day}
+		if err := rows.Scan(&u.IPAddress, &u.Egress, &u.Ingress); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
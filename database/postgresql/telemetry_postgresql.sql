@@ -51,12 +51,25 @@ CREATE TABLE speedtest_users (
     ping text,
     jitter text,
     log text,
-    uuid text
+    uuid text,
+    server_info text
 );
 
 -- Commented out the following line because it assumes the user of the speedtest server, @bplower
 -- ALTER TABLE speedtest_users OWNER TO speedtest;
 
+--
+-- Name: speedtest_quota; Type: TABLE; Schema: public; Owner: speedtest
+--
+
+CREATE TABLE speedtest_quota (
+    day date NOT NULL,
+    ip text NOT NULL,
+    egress bigint DEFAULT 0 NOT NULL,
+    ingress bigint DEFAULT 0 NOT NULL,
+    PRIMARY KEY (day, ip)
+);
+
 --
 -- Name: speedtest_users_id_seq; Type: SEQUENCE; Schema: public; Owner: speedtest
 --
@@ -17,6 +17,19 @@ type TelemetryData struct {
 	Jitter    string
 	Log       string
 	UUID      string
+	// JSON measured by the server itself, such as TCP_INFO of the connection
+	ServerInfo string
+}
+
+// QuotaUsage is the test traffic of a client, or of the whole server if IPAddress is empty, on a day
+type QuotaUsage struct {
+	// start of the day in UTC
+	Day       time.Time
+	IPAddress string
+	// bytes sent by downloads
+	Egress int64
+	// bytes accepted from uploads
+	Ingress int64
 }
 
 type Config struct {
@@ -31,4 +44,8 @@ type DataAccess interface {
 	Insert(*TelemetryData) error
 	FetchByUUID(string) (*TelemetryData, error)
 	FetchLast100() ([]TelemetryData, error)
+	// AddQuotaUsage adds the given traffic to the counters stored for each day and IP address
+	AddQuotaUsage([]QuotaUsage) error
+	// FetchQuotaUsage returns all counters of a day
+	FetchQuotaUsage(day time.Time) ([]QuotaUsage, error)
 }
@@ -0,0 +1,235 @@
+// Package iperf implements the server side of the iperf3 protocol, so that
+// `iperf3 -c` can be run against a LibreSpeed host.
+//
+// Like iperf3 itself, only one test runs at a time. The control connection and
+// TCP data streams share the TCP port, UDP data streams use the same port number over UDP.
+package iperf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+)
+
+// protocol states, sent as a single signed byte on the control connection
+const (
+	testStart       = 1
+	testRunning     = 2
+	testEnd         = 4
+	paramExchange   = 9
+	createStreams   = 10
+	serverTerminate = 11
+	clientTerminate = 12
+	exchangeResults = 13
+	displayResults  = 14
+	iperfDone       = 16
+	accessDenied    = -1
+	serverError     = -2
+)
+
+const (
+	// 36 characters and a terminating NUL
+	cookieSize = 37
+	// largest JSON message accepted from a client
+	maxJSONSize = 1 << 20
+
+	setupTimeout = 10 * time.Second
+)
+
+// params is the subset of the client's parameters the server acts upon
+type params struct {
+	TCP           bool   `json:"tcp"`
+	UDP           bool   `json:"udp"`
+	Time          int    `json:"time"`
+	Num           int64  `json:"num"`
+	BlockCount    int64  `json:"blockcount"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse"`
+	Bidirectional bool   `json:"bidirectional"`
+	Len           int    `json:"len"`
+	Bandwidth     int64  `json:"bandwidth"`
+	Counters64Bit bool   `json:"udp_counters_64bit"`
+	ClientVersion string `json:"client_version"`
+}
+
+type testResults struct {
+	CPUUtilTotal         float64         `json:"cpu_util_total"`
+	CPUUtilUser          float64         `json:"cpu_util_user"`
+	CPUUtilSystem        float64         `json:"cpu_util_system"`
+	SenderHasRetransmits int             `json:"sender_has_retransmits"`
+	Streams              []streamResults `json:"streams"`
+}
+
+type streamResults struct {
+	ID            int     `json:"id"`
+	Bytes         int64   `json:"bytes"`
+	Retransmits   int     `json:"retransmits"`
+	Jitter        float64 `json:"jitter"`
+	Errors        int64   `json:"errors"`
+	OmittedErrors int64   `json:"omitted_errors"`
+	Packets       int64   `json:"packets"`
+	StartTime     float64 `json:"start_time"`
+	EndTime       float64 `json:"end_time"`
+}
+
+type Server struct {
+	maxDuration time.Duration
+
+	mu      sync.Mutex
+	current *test
+}
+
+// ListenAndServe runs the iperf3 server on the configured port until ctx is done
+func ListenAndServe(ctx context.Context, conf *config.Config) error {
+	// quotas are kept by the web server, iperf3 tests would get around them
+	for _, quota := range []string{conf.QuotaDownloadPerIP, conf.QuotaUploadPerIP, conf.QuotaDownload, conf.QuotaUpload} {
+		if quota != "" {
+			return errors.New("iperf_port can't be used together with quotas")
+		}
+	}
+	addr := net.JoinHostPort(conf.BindAddress, conf.IperfPort)
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		_ = tcp.Close()
+		return fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	}
+	slog.Info("Starting iperf3 server on", "address", addr)
+
+	s := &Server{maxDuration: conf.IperfMaxDuration}
+	return s.serve(ctx, tcp, udp)
+}
+
+func (s *Server) serve(ctx context.Context, tcp net.Listener, udp net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		_ = tcp.Close()
+		_ = udp.Close()
+	}()
+	go s.serveUDP(udp)
+
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("iperf3 server closed")
+				return nil
+			}
+			return fmt.Errorf("accepting iperf3 connection: %w", err)
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn tells control connections and data streams apart by their cookie
+func (s *Server) handleConn(conn net.Conn) {
+	cookie := make([]byte, cookieSize)
+	_ = conn.SetReadDeadline(time.Now().Add(setupTimeout))
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		slog.Debug("reading iperf3 cookie", slog.Any("error", err))
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	s.mu.Lock()
+	t := s.current
+	if t != nil {
+		s.mu.Unlock()
+		if bytes.Equal(cookie, t.cookie) && t.addTCPStream(conn) {
+			return
+		}
+		_ = writeState(conn, accessDenied)
+		_ = conn.Close()
+		return
+	}
+	t = newTest(s, conn, cookie)
+	s.current = t
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.current = nil
+		s.mu.Unlock()
+	}()
+	if err := t.run(); err != nil {
+		slog.Error("iperf3 test failed", slog.String("client", conn.RemoteAddr().String()), slog.Any("error", err))
+	}
+}
+
+func (s *Server) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Debug("reading iperf3 UDP stream", slog.Any("error", err))
+			continue
+		}
+
+		s.mu.Lock()
+		t := s.current
+		s.mu.Unlock()
+		if t != nil {
+			t.handleDatagram(conn, addr, buf[:n])
+		}
+	}
+}
+
+func writeState(w io.Writer, state int8) error {
+	_, err := w.Write([]byte{byte(state)})
+	return err
+}
+
+func readState(r io.Reader) (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+// writeJSON sends v prefixed by its big endian uint32 length, like iperf3's JSON_write
+func writeJSON(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	copy(msg[4:], b)
+	_, err = w.Write(msg)
+	return err
+}
+
+// readJSON reads a length prefixed JSON message, returning the raw message as well
+func readJSON(r io.Reader, v any) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxJSONSize {
+		return nil, fmt.Errorf("JSON message too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, json.Unmarshal(b, v)
+}
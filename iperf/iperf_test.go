@@ -0,0 +1,197 @@
+package iperf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database"
+	"github.com/librespeed/speedtest/database/memory"
+	"github.com/librespeed/speedtest/database/schema"
+)
+
+// runClient plays the client side of a single stream TCP test
+func runClient(t *testing.T, addr string, p params) testResults {
+	t.Helper()
+	cookie := []byte(strings.Repeat("c", cookieSize-1) + "\x00")
+
+	expectState := func(conn net.Conn, want int8) {
+		t.Helper()
+		got, err := readState(conn)
+		if err != nil || got != want {
+			t.Fatalf("state = %d, %v, want %d", got, err, want)
+		}
+	}
+
+	ctrl, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial control: %v", err)
+	}
+	defer ctrl.Close()
+	_ = ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+	_, _ = ctrl.Write(cookie)
+	expectState(ctrl, paramExchange)
+	if err := writeJSON(ctrl, p); err != nil {
+		t.Fatalf("write params: %v", err)
+	}
+	expectState(ctrl, createStreams)
+
+	data, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial data: %v", err)
+	}
+	defer data.Close()
+	_, _ = data.Write(cookie)
+	expectState(ctrl, testStart)
+	expectState(ctrl, testRunning)
+
+	if p.Reverse {
+		buf := make([]byte, 64*1024)
+		_ = data.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			if _, err := data.Read(buf); err != nil {
+				break
+			}
+		}
+	} else {
+		block := make([]byte, 64*1024)
+		for i := 0; i < 16; i++ {
+			_, _ = data.Write(block)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	_ = writeState(ctrl, testEnd)
+	expectState(ctrl, exchangeResults)
+	if err := writeJSON(ctrl, testResults{Streams: []streamResults{{ID: 1}}}); err != nil {
+		t.Fatalf("write results: %v", err)
+	}
+	var res testResults
+	if _, err := readJSON(ctrl, &res); err != nil {
+		t.Fatalf("read results: %v", err)
+	}
+	expectState(ctrl, displayResults)
+	_ = writeState(ctrl, iperfDone)
+	return res
+}
+
+// waitIdle waits for the server to finish the current test, which it does after the client is done
+func waitIdle(t *testing.T, s *Server) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		idle := s.current == nil
+		s.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server still busy")
+}
+
+func TestServerTCP(t *testing.T) {
+	mem, _ := memory.Open(schema.Config{})
+	database.DB = mem
+	config.LoadedConfig().DatabaseType = "memory"
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &Server{maxDuration: time.Minute}
+	go func() { _ = s.serve(ctx, tcp, udp) }()
+
+	res := runClient(t, tcp.Addr().String(), params{TCP: true, Time: 1, ClientVersion: "3.16"})
+	if len(res.Streams) != 1 || res.Streams[0].ID != 1 || res.Streams[0].Bytes != 16*64*1024 {
+		t.Errorf("forward results = %+v", res)
+	}
+
+	waitIdle(t, s)
+	res = runClient(t, tcp.Addr().String(), params{TCP: true, Time: 1, Reverse: true, Len: 1024})
+	if len(res.Streams) != 1 || res.Streams[0].Bytes == 0 {
+		t.Errorf("reverse results = %+v", res)
+	}
+
+	waitIdle(t, s)
+	records, _ := mem.FetchLast100()
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	var extra recordExtra
+	if err := json.Unmarshal([]byte(records[0].Extra), &extra); err != nil || extra.Source != "iperf3" {
+		t.Errorf("record extra = %q, %v", records[0].Extra, err)
+	}
+	if records[0].Upload == "" || records[0].UserAgent != "iperf3/3.16" || records[1].Download == "" {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+func TestAccessDeniedWhileBusy(t *testing.T) {
+	s := &Server{current: newTest(nil, nil, bytes.Repeat([]byte{1}, cookieSize))}
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.handleConn(server)
+
+	_, _ = client.Write(bytes.Repeat([]byte{2}, cookieSize))
+	if state, err := readState(client); err != nil || state != accessDenied {
+		t.Errorf("state = %d, %v, want %d", state, err, accessDenied)
+	}
+}
+
+func TestUDPStreamValidation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	ctrl, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer ctrl.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	defer udp.Close()
+
+	tst := newTest(nil, ctrl, nil)
+	tst.params = params{UDP: true, Parallel: 1}
+	tst.accepting = true
+	connect := binary.LittleEndian.AppendUint32(nil, udpConnectMsg)
+
+	tst.handleDatagram(udp, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5201}, connect)
+	tst.handleDatagram(udp, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5201}, []byte("hello"))
+	if len(tst.streams) != 0 {
+		t.Fatalf("registered %d streams from a foreign address or without the connect message", len(tst.streams))
+	}
+	tst.handleDatagram(udp, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5201}, connect)
+	if len(tst.streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(tst.streams))
+	}
+}
+
+func TestRefusedWithQuotas(t *testing.T) {
+	conf := &config.Config{BindAddress: "127.0.0.1", IperfPort: "0", QuotaDownloadPerIP: "1GB"}
+	if err := ListenAndServe(context.Background(), conf); err == nil {
+		t.Fatal("started with quotas configured")
+	}
+}
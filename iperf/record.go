@@ -0,0 +1,88 @@
+package iperf
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database"
+	"github.com/librespeed/speedtest/database/schema"
+	"github.com/oklog/ulid/v2"
+)
+
+// recordExtra is stored in the extra field, so iperf3 runs can be told apart on the stats page
+type recordExtra struct {
+	Source   string `json:"source"`
+	Protocol string `json:"protocol"`
+	Streams  int    `json:"streams"`
+	Reverse  bool   `json:"reverse"`
+	Duration string `json:"duration"`
+}
+
+// record stores the test in the database, the same way telemetry from the web client is stored
+func (t *test) record(res testResults, end time.Time, clientResults json.RawMessage) {
+	conf := config.LoadedConfig()
+	if conf.DatabaseType == "none" {
+		return
+	}
+
+	var bytes int64
+	var jitter float64
+	for _, s := range res.Streams {
+		bytes += s.Bytes
+		jitter += s.Jitter
+	}
+	elapsed := end.Sub(t.start)
+	mbps := ""
+	if elapsed > 0 {
+		mbps = strconv.FormatFloat(float64(bytes*8)/elapsed.Seconds()/1e6, 'f', 2, 64)
+	}
+
+	ipAddr := t.clientIP()
+	if conf.RedactIP {
+		ipAddr = "0.0.0.0"
+	}
+
+	protocol := "tcp"
+	if t.params.UDP {
+		protocol = "udp"
+	}
+	extra, _ := json.Marshal(recordExtra{
+		Source:   "iperf3",
+		Protocol: protocol,
+		Streams:  len(res.Streams),
+		Reverse:  t.params.Reverse,
+		Duration: elapsed.Round(time.Millisecond).String(),
+	})
+	ispInfo, _ := json.Marshal(map[string]string{"processedString": ipAddr + " - iperf3"})
+
+	var record schema.TelemetryData
+	record.IPAddress = ipAddr
+	record.ISPInfo = string(ispInfo)
+	record.Extra = string(extra)
+	record.UserAgent = "iperf3"
+	if t.params.ClientVersion != "" {
+		record.UserAgent += "/" + t.params.ClientVersion
+	}
+	// the server sends in reverse mode, so that's the client's download
+	if t.params.Reverse {
+		record.Download = mbps
+	} else {
+		record.Upload = mbps
+	}
+	if t.params.UDP && !t.params.Reverse && len(res.Streams) > 0 {
+		record.Jitter = strconv.FormatFloat(jitter/float64(len(res.Streams))*1000, 'f', 2, 64)
+	}
+	record.Log = string(clientResults)
+
+	now := time.Now()
+	entropy := ulid.Monotonic(rand.New(rand.NewSource(now.UnixNano())), 0)
+	record.UUID = ulid.MustNew(ulid.Timestamp(now), entropy).String()
+
+	if err := database.DB.Insert(&record); err != nil {
+		slog.Error("inserting iperf3 result into database", slog.Any("error", err))
+	}
+}
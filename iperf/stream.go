@@ -0,0 +1,223 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// The first datagram of a UDP stream is UDP_CONNECT_MSG, which the server answers with
+// UDP_CONNECT_REPLY. iperf3 writes them in host byte order, which is little endian on every
+// platform that matters, and versions before 3.13 used other values.
+const (
+	udpConnectMsg       = 0x36373839
+	legacyUDPConnectMsg = 123456789
+)
+
+var (
+	udpConnectReply       = binary.LittleEndian.AppendUint32(nil, 0x39383736)
+	legacyUDPConnectReply = binary.LittleEndian.AppendUint32(nil, 987654321)
+)
+
+// stream is a single TCP connection or UDP flow of a test
+type stream struct {
+	id int
+
+	// TCP streams
+	conn net.Conn
+	// UDP streams
+	udp  net.PacketConn
+	addr net.Addr
+
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	bytes int64
+	// UDP statistics, as computed by iperf3: packets is the highest sequence number
+	// received or sent, errors the number of missing packets
+	packets     int64
+	errors      int64
+	outOfOrder  int64
+	jitter      float64
+	prevTransit float64
+	hasTransit  bool
+}
+
+func newTCPStream(conn net.Conn) *stream {
+	return &stream{conn: conn, done: make(chan struct{})}
+}
+
+func newUDPStream(conn net.PacketConn, addr net.Addr) *stream {
+	return &stream{udp: conn, addr: addr, done: make(chan struct{})}
+}
+
+func (s *stream) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+	})
+}
+
+func (s *stream) run(t *test) {
+	switch {
+	case s.conn != nil && t.params.Reverse:
+		s.sendTCP(t)
+	case s.conn != nil:
+		s.receiveTCP()
+	case t.params.Reverse:
+		s.sendUDP(t)
+	default:
+		// datagrams are delivered by the server's UDP loop
+		<-s.done
+	}
+}
+
+func (s *stream) addBytes(n int) {
+	s.mu.Lock()
+	s.bytes += int64(n)
+	s.mu.Unlock()
+}
+
+func (s *stream) receiveTCP() {
+	buf := make([]byte, defaultTCPBlockSize)
+	for {
+		n, err := s.conn.Read(buf)
+		s.addBytes(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *stream) sendTCP(t *test) {
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if !t.takeBlock() {
+			return
+		}
+		n, err := s.conn.Write(t.payload)
+		s.addBytes(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendUDP sends datagrams paced to the requested bandwidth, each starting with
+// the send time in seconds and microseconds and the sequence number, all big endian
+func (s *stream) sendUDP(t *test) {
+	block := append([]byte(nil), t.payload...)
+	start := time.Now()
+	var sent int64
+	for seq := int64(1); ; seq++ {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if !t.takeBlock() {
+			return
+		}
+
+		if bw := t.params.Bandwidth; bw > 0 {
+			due := start.Add(time.Duration(float64(sent*8) / float64(bw) * float64(time.Second)))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-s.done:
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		now := time.Now()
+		binary.BigEndian.PutUint32(block, uint32(now.Unix()))
+		binary.BigEndian.PutUint32(block[4:], uint32(now.Nanosecond()/1000))
+		if t.params.Counters64Bit {
+			binary.BigEndian.PutUint64(block[8:], uint64(seq))
+		} else {
+			binary.BigEndian.PutUint32(block[8:], uint32(seq))
+		}
+		n, err := s.udp.WriteTo(block, s.addr)
+		if err != nil {
+			slog.Debug("sending iperf3 UDP datagram", slog.Any("error", err))
+			return
+		}
+		sent += int64(n)
+
+		s.mu.Lock()
+		s.bytes += int64(n)
+		s.packets = seq
+		s.mu.Unlock()
+	}
+}
+
+func (s *stream) receiveDatagram(b []byte, arrived time.Time, counters64Bit bool) {
+	headerSize := 12
+	if counters64Bit {
+		headerSize = 16
+	}
+	if len(b) < headerSize {
+		return
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:]))*1000)
+	var seq int64
+	if counters64Bit {
+		seq = int64(binary.BigEndian.Uint64(b[8:]))
+	} else {
+		seq = int64(binary.BigEndian.Uint32(b[8:]))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += int64(len(b))
+
+	// same bookkeeping as iperf_udp_recv
+	if seq >= s.packets+1 {
+		if seq > s.packets+1 {
+			s.errors += seq - 1 - s.packets
+		}
+		s.packets = seq
+	} else {
+		s.outOfOrder++
+		if s.errors > 0 {
+			s.errors--
+		}
+	}
+
+	transit := arrived.Sub(sent).Seconds()
+	if s.hasTransit {
+		d := transit - s.prevTransit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.prevTransit = transit
+	s.hasTransit = true
+}
+
+func (s *stream) results() streamResults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := streamResults{
+		ID:          s.id,
+		Bytes:       s.bytes,
+		Retransmits: -1,
+	}
+	if s.udp != nil {
+		ret.Jitter = s.jitter
+		ret.Errors = s.errors
+		ret.Packets = s.packets
+	}
+	return ret
+}
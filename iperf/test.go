@@ -0,0 +1,316 @@
+package iperf
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTCPBlockSize = 128 * 1024
+	defaultUDPBlockSize = 1460
+)
+
+// test is a single iperf3 run, driven by the client over the control connection
+type test struct {
+	server *Server
+	ctrl   net.Conn
+	cookie []byte
+	params params
+	// payload sent on reverse streams, and how much of it may be sent in total
+	payload []byte
+	limit   int64
+
+	mu        sync.Mutex
+	sent      int64
+	accepting bool
+	running   bool
+	streams   []*stream
+	ready     chan struct{}
+	start     time.Time
+	wg        sync.WaitGroup
+}
+
+func newTest(s *Server, ctrl net.Conn, cookie []byte) *test {
+	return &test{
+		server: s,
+		ctrl:   ctrl,
+		cookie: cookie,
+		ready:  make(chan struct{}),
+	}
+}
+
+func (t *test) run() error {
+	defer t.close()
+
+	if err := writeState(t.ctrl, paramExchange); err != nil {
+		return err
+	}
+	_ = t.ctrl.SetReadDeadline(time.Now().Add(setupTimeout))
+	if _, err := readJSON(t.ctrl, &t.params); err != nil {
+		return fmt.Errorf("reading parameters: %w", err)
+	}
+	if err := t.normalizeParams(); err != nil {
+		_ = writeState(t.ctrl, serverError)
+		// i_errno and errno, zero as they have no meaning outside of iperf3 itself
+		_, _ = t.ctrl.Write(make([]byte, 8))
+		return err
+	}
+
+	t.payload = make([]byte, t.params.Len)
+	if _, err := rand.Read(t.payload); err != nil {
+		return fmt.Errorf("generating payload: %w", err)
+	}
+	t.limit = t.params.Num
+	if t.params.BlockCount > 0 {
+		t.limit = t.params.BlockCount * int64(t.params.Len)
+	}
+
+	t.mu.Lock()
+	t.accepting = true
+	t.mu.Unlock()
+	if err := writeState(t.ctrl, createStreams); err != nil {
+		return err
+	}
+	select {
+	case <-t.ready:
+	case <-time.After(setupTimeout):
+		return errors.New("timed out waiting for data streams")
+	}
+
+	t.mu.Lock()
+	t.accepting = false
+	t.running = true
+	t.start = time.Now()
+	for _, s := range t.streams {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			s.run(t)
+		}()
+	}
+	t.mu.Unlock()
+
+	if err := writeState(t.ctrl, testStart); err != nil {
+		return err
+	}
+	if err := writeState(t.ctrl, testRunning); err != nil {
+		return err
+	}
+
+	deadline := time.Time{}
+	if max := t.server.maxDuration; max > 0 {
+		deadline = t.start.Add(max)
+	}
+	_ = t.ctrl.SetReadDeadline(deadline)
+	state, err := readState(t.ctrl)
+	end := time.Now()
+	t.stopStreams()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		_ = writeState(t.ctrl, serverTerminate)
+		return fmt.Errorf("test exceeded maximum duration of %s", t.server.maxDuration)
+	}
+	if err != nil {
+		return fmt.Errorf("reading test state: %w", err)
+	}
+	switch state {
+	case testEnd:
+	case clientTerminate:
+		slog.Info("iperf3 test terminated by client", slog.String("client", t.ctrl.RemoteAddr().String()))
+		return nil
+	default:
+		return fmt.Errorf("unexpected state %d from client", state)
+	}
+
+	_ = t.ctrl.SetReadDeadline(time.Now().Add(setupTimeout))
+	if err := writeState(t.ctrl, exchangeResults); err != nil {
+		return err
+	}
+	var clientResults json.RawMessage
+	if _, err := readJSON(t.ctrl, &clientResults); err != nil {
+		return fmt.Errorf("reading client results: %w", err)
+	}
+	res := t.results(end)
+	if err := writeJSON(t.ctrl, res); err != nil {
+		return err
+	}
+	if err := writeState(t.ctrl, displayResults); err != nil {
+		return err
+	}
+	if state, err := readState(t.ctrl); err != nil || state != iperfDone {
+		slog.Debug("iperf3 client didn't finish cleanly", slog.Int("state", int(state)), slog.Any("error", err))
+	}
+
+	t.record(res, end, clientResults)
+	return nil
+}
+
+func (t *test) normalizeParams() error {
+	p := &t.params
+	if p.Bidirectional {
+		return errors.New("bidirectional tests are not supported")
+	}
+	if !p.UDP {
+		p.TCP = true
+	}
+	if p.Parallel <= 0 {
+		p.Parallel = 1
+	}
+	if p.Parallel > 128 {
+		return fmt.Errorf("too many parallel streams: %d", p.Parallel)
+	}
+	if p.Len <= 0 {
+		p.Len = defaultTCPBlockSize
+		if p.UDP {
+			p.Len = defaultUDPBlockSize
+		}
+	}
+	if p.Len > 1024*1024 || (p.UDP && p.Len > 65507) {
+		return fmt.Errorf("block size too large: %d", p.Len)
+	}
+	// room for the UDP header with 64 bit counters
+	if p.UDP && p.Len < 16 {
+		return fmt.Errorf("block size too small: %d", p.Len)
+	}
+	return nil
+}
+
+// addStream registers a new data stream, returning false if the test doesn't expect any more
+func (t *test) addStream(s *stream) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// params are only safe to read once the test is accepting streams
+	if !t.accepting || len(t.streams) >= t.params.Parallel || t.params.UDP != (s.udp != nil) {
+		return false
+	}
+	// iperf3 numbers streams 1, 3, 4, 5...
+	s.id = 1
+	if len(t.streams) > 0 {
+		s.id = len(t.streams) + 2
+	}
+	t.streams = append(t.streams, s)
+	if len(t.streams) == t.params.Parallel {
+		close(t.ready)
+	}
+	return true
+}
+
+func (t *test) addTCPStream(conn net.Conn) bool {
+	return t.addStream(newTCPStream(conn))
+}
+
+func (t *test) handleDatagram(conn net.PacketConn, addr net.Addr, b []byte) {
+	t.mu.Lock()
+	var s *stream
+	for _, v := range t.streams {
+		if v.addr != nil && v.addr.String() == addr.String() {
+			s = v
+			break
+		}
+	}
+	receiving := t.running && !t.params.Reverse
+	counters64Bit := t.params.Counters64Bit
+	t.mu.Unlock()
+
+	if s == nil {
+		// the first datagram of a stream is UDP_CONNECT_MSG, which is just answered. Streams
+		// are only accepted from the client's own address, so a spoofed datagram can't point
+		// a reverse test at someone else.
+		if len(b) < 4 || !sameHost(addr, t.ctrl.RemoteAddr()) {
+			return
+		}
+		var reply []byte
+		switch binary.LittleEndian.Uint32(b) {
+		case udpConnectMsg:
+			reply = udpConnectReply
+		case legacyUDPConnectMsg:
+			reply = legacyUDPConnectReply
+		default:
+			return
+		}
+		if !t.addStream(newUDPStream(conn, addr)) {
+			return
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			slog.Debug("answering iperf3 UDP connect", slog.Any("error", err))
+		}
+		return
+	}
+	if receiving {
+		s.receiveDatagram(b, time.Now(), counters64Bit)
+	}
+}
+
+// sameHost reports whether a and b have the same IP address
+func sameHost(a, b net.Addr) bool {
+	ip := func(addr net.Addr) netip.Addr {
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}
+		}
+		return ap.Addr().Unmap()
+	}
+	x := ip(a)
+	return x.IsValid() && x == ip(b)
+}
+
+// takeBlock reserves a block for a reverse stream to send, returning false once
+// the test's byte or block count has been reached
+func (t *test) takeBlock() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limit > 0 && t.sent >= t.limit {
+		return false
+	}
+	t.sent += int64(len(t.payload))
+	return true
+}
+
+func (t *test) stopStreams() {
+	t.mu.Lock()
+	t.running = false
+	for _, s := range t.streams {
+		s.stop()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+func (t *test) close() {
+	t.stopStreams()
+	_ = t.ctrl.Close()
+}
+
+func (t *test) results(end time.Time) testResults {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := testResults{
+		SenderHasRetransmits: 0,
+		Streams:              make([]streamResults, 0, len(t.streams)),
+	}
+	if !t.params.Reverse {
+		res.SenderHasRetransmits = -1
+	}
+	for _, s := range t.streams {
+		sr := s.results()
+		sr.EndTime = end.Sub(t.start).Seconds()
+		res.Streams = append(res.Streams, sr)
+	}
+	return res
+}
+
+func (t *test) clientIP() string {
+	host, _, err := net.SplitHostPort(t.ctrl.RemoteAddr().String())
+	if err != nil {
+		return t.ctrl.RemoteAddr().String()
+	}
+	return host
+}
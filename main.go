@@ -13,7 +13,10 @@ import (
 
 	"github.com/librespeed/speedtest/config"
 	"github.com/librespeed/speedtest/database"
+	"github.com/librespeed/speedtest/iperf"
+	"github.com/librespeed/speedtest/pow"
 	"github.com/librespeed/speedtest/results"
+	"github.com/librespeed/speedtest/token"
 	"github.com/librespeed/speedtest/web"
 	"github.com/rs/zerolog"
 	slogzerolog "github.com/samber/slog-zerolog/v2"
@@ -48,6 +51,8 @@ func main() {
 	}
 	web.SetServerLocation(conf)
 	results.Initialize(conf)
+	token.Initialize(conf)
+	pow.Initialize(conf)
 	err = database.SetDBInfo(conf)
 	if err != nil {
 		slog.Error("init db", slog.Any("error", err))
@@ -63,6 +68,15 @@ func main() {
 		}
 		closeFn()
 	}()
+	if conf.IperfPort != "" {
+		go func() {
+			err := iperf.ListenAndServe(ctx, conf)
+			if err != nil {
+				slog.Error("iperf3 server", slog.Any("error", err))
+			}
+			closeFn()
+		}()
+	}
 	go wait(closeFn)
 	<-stopWait
 	slog.Info("server stopped")
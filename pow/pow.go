@@ -0,0 +1,149 @@
+// Package pow makes clients pay for large downloads with CPU time. The server hands out
+// challenges, and accepts a challenge as solved once the client has found a string for which
+// SHA-256(challenge + ":" + solution) starts with as many zero bits as the challenge asks for.
+// Finding one takes 2^difficulty hashes on average, while checking it takes a single one.
+//
+// Challenges are signed values, see package signed, whose data is the difficulty, so that it
+// can't be lowered by the client. Each challenge is bound to the address it was issued to
+// and is accepted once.
+package pow
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"math/bits"
+	"strconv"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/signed"
+)
+
+// more than enough to keep any client busy for ages
+const maxDifficulty = 40
+
+var (
+	ErrMalformed = signed.ErrMalformed
+	ErrInvalid   = signed.ErrInvalid
+	ErrExpired   = signed.ErrExpired
+	ErrUsed      = signed.ErrUsed
+	ErrUnsolved  = errors.New("challenge not solved")
+)
+
+// Challenge is sent to clients as JSON
+type Challenge struct {
+	Challenge string `json:"challenge"`
+	// number of leading zero bits the hash must have
+	Difficulty int       `json:"difficulty"`
+	Algorithm  string    `json:"algorithm"`
+	Expires    time.Time `json:"expires"`
+}
+
+type Issuer struct {
+	signer     *signed.Signer
+	difficulty int
+	ttl        time.Duration
+}
+
+// NewIssuer returns an Issuer of challenges with the given difficulty, valid for ttl
+func NewIssuer(secret []byte, difficulty int, ttl time.Duration) *Issuer {
+	return &Issuer{
+		signer:     signed.NewSigner(secret),
+		difficulty: min(max(difficulty, 0), maxDifficulty),
+		ttl:        ttl,
+	}
+}
+
+// issuer is nil unless pow_difficulty is configured
+var issuer *Issuer
+
+// Initialize sets up the issuer used by Issue and Verify from the configuration. Without
+// pow_secret the issuer makes up its own secret, and servers sharing clients through a load
+// balancer won't accept each other's challenges.
+func Initialize(conf *config.Config) {
+	if conf.PowDifficulty <= 0 {
+		issuer = nil
+		return
+	}
+	if conf.PowDifficulty > maxDifficulty {
+		slog.Warn("pow_difficulty is too high, using the maximum",
+			slog.Int("difficulty", conf.PowDifficulty), slog.Int("max", maxDifficulty))
+	}
+	secret := []byte(conf.PowSecret)
+	if len(secret) == 0 {
+		slog.Info("pow_secret is not set, using a random secret")
+		secret = signed.RandomSecret()
+	}
+	ttl := conf.PowTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	issuer = NewIssuer(secret, conf.PowDifficulty, ttl)
+}
+
+// Enabled reports whether proof-of-work is required
+func Enabled() bool {
+	return issuer != nil
+}
+
+// Issue returns a challenge for the client at ip, using the configured issuer
+func Issue(ip string) Challenge {
+	return issuer.Issue(ip, time.Now())
+}
+
+// Verify checks a solved challenge presented by the client at ip, using the configured issuer
+func Verify(challenge, solution, ip string) error {
+	return issuer.Verify(challenge, solution, ip, time.Now())
+}
+
+// Issue returns a challenge for the client at ip, valid from now until the issuer's TTL has passed
+func (i *Issuer) Issue(ip string, now time.Time) Challenge {
+	expires := now.Add(i.ttl)
+	return Challenge{
+		Challenge:  i.signer.Sign([]byte{byte(i.difficulty)}, ip, expires),
+		Difficulty: i.difficulty,
+		Algorithm:  "sha256",
+		Expires:    time.Unix(expires.Unix(), 0).UTC(),
+	}
+}
+
+// Verify checks that challenge was issued to the client at ip, hasn't expired and is solved
+// by solution at the difficulty it was issued with. The challenge can't be used again.
+func (i *Issuer) Verify(challenge, solution, ip string, now time.Time) error {
+	v, err := i.signer.Open(challenge, ip, 1, now)
+	if err != nil {
+		return err
+	}
+	if !Solved(challenge, solution, int(v.Data[0])) {
+		return ErrUnsolved
+	}
+	return i.signer.Use(v, now)
+}
+
+// Solved reports whether the hash of challenge and solution starts with difficulty zero bits
+func Solved(challenge, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	return leadingZeros(sum[:]) >= difficulty
+}
+
+// Solve finds a solution to challenge by trying decimal numbers
+func Solve(challenge string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		s := strconv.FormatUint(n, 10)
+		if Solved(challenge, s, difficulty) {
+			return s
+		}
+	}
+}
+
+func leadingZeros(b []byte) int {
+	var n int
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
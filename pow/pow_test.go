@@ -0,0 +1,63 @@
+package pow
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIssuer(t *testing.T) {
+	i := NewIssuer([]byte("secret"), 8, time.Minute)
+	now := time.Now()
+	c := i.Issue("192.0.2.1", now)
+	if c.Difficulty != 8 || c.Algorithm != "sha256" {
+		t.Fatalf("challenge = %+v", c)
+	}
+	solution := Solve(c.Challenge, c.Difficulty)
+
+	if err := i.Verify(c.Challenge, solution, "198.51.100.1", now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other client: %v", err)
+	}
+	if err := i.Verify(c.Challenge, solution, "192.0.2.1", now.Add(2*time.Minute)); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired: %v", err)
+	}
+	if err := i.Verify("garbage", solution, "192.0.2.1", now); !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed: %v", err)
+	}
+	// the difficulty is part of the signed payload, so it can't be lowered
+	if err := NewIssuer([]byte("secret"), 1, time.Minute).Verify(c.Challenge, solution, "192.0.2.1", now); err != nil {
+		t.Errorf("issued with another difficulty: %v", err)
+	}
+	unsolved := "0"
+	for Solved(c.Challenge, unsolved, c.Difficulty) {
+		unsolved += "0"
+	}
+	c = i.Issue("192.0.2.1", now)
+	solution = Solve(c.Challenge, c.Difficulty)
+	if err := i.Verify(c.Challenge, unsolved, "192.0.2.1", now); !errors.Is(err, ErrUnsolved) {
+		t.Errorf("unsolved: %v", err)
+	}
+
+	if err := i.Verify(c.Challenge, solution, "192.0.2.1", now); err != nil {
+		t.Fatalf("valid solution: %v", err)
+	}
+	if err := i.Verify(c.Challenge, solution, "192.0.2.1", now); !errors.Is(err, ErrUsed) {
+		t.Errorf("reused: %v", err)
+	}
+}
+
+func TestLeadingZeros(t *testing.T) {
+	for _, tc := range []struct {
+		b    []byte
+		want int
+	}{
+		{[]byte{0x80, 0}, 0},
+		{[]byte{0x01, 0xff}, 7},
+		{[]byte{0, 0x10}, 11},
+		{[]byte{0, 0}, 16},
+	} {
+		if got := leadingZeros(tc.b); got != tc.want {
+			t.Errorf("leadingZeros(%x) = %d, want %d", tc.b, got, tc.want)
+		}
+	}
+}
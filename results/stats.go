@@ -31,6 +31,13 @@ var (
 
 func Initialize(c *config.Config) {
 	conf = c
+	switch c.TelemetryVerification {
+	case verificationOff, verificationFlag, verificationReject:
+	default:
+		slog.Warn("unknown telemetry_verification, flagging unverified results",
+			slog.String("telemetry_verification", c.TelemetryVerification))
+		c.TelemetryVerification = verificationFlag
+	}
 	store.Options = &sessions.Options{
 		Path:     conf.BaseURL + "/stats",
 		MaxAge:   3600 * 1, // 1 hour
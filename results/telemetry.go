@@ -20,6 +20,8 @@ import (
 	"github.com/librespeed/speedtest/config"
 	"github.com/librespeed/speedtest/database"
 	"github.com/librespeed/speedtest/database/schema"
+	"github.com/librespeed/speedtest/tcpconn"
+	"github.com/librespeed/speedtest/token"
 
 	"github.com/golang/freetype"
 	"github.com/golang/freetype/truetype"
@@ -72,6 +74,19 @@ var (
 type Result struct {
 	ProcessedString string         `json:"processedString"`
 	RawISPInfo      IPInfoResponse `json:"rawIspInfo"`
+	// kernel TCP statistics of the connection the request was received on, Linux only
+	TCPInfo *tcpconn.Info `json:"tcpInfo,omitempty"`
+	// test session to pass to garbage, empty and telemetry, if telemetry is verified
+	Session string `json:"session,omitempty"`
+	// signed token the client submits with its telemetry
+	Token string `json:"token,omitempty"`
+}
+
+// ServerInfo is stored with every telemetry record, unlike the other fields
+// it is measured by the server and can't be made up by the client
+type ServerInfo struct {
+	TCPInfo      *tcpconn.Info `json:"tcpInfo,omitempty"`
+	Verification *Verification `json:"verification,omitempty"`
 }
 
 type IPInfoResponse struct {
@@ -154,6 +169,17 @@ func Record(w http.ResponseWriter, r *http.Request) {
 
 	ipAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
 	userAgent := r.UserAgent()
+	// before the address is redacted
+	clientIP := ipAddr
+
+	// tokens aren't checked otherwise, in multi server setups they may come from servers with another secret
+	if conf.TelemetryRequireToken {
+		if err := token.Verify(r.FormValue("token"), clientIP); err != nil {
+			slog.Info("rejected telemetry token", slog.String("ip", clientIP), slog.Any("error", err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
 	language := r.Header.Get("Accept-Language")
 
 	ispInfo := r.FormValue("ispinfo")
@@ -190,6 +216,21 @@ func Record(w http.ResponseWriter, r *http.Request) {
 	record.Jitter = jitter
 	record.Log = logs
 
+	info := ServerInfo{}
+	if ti, err := tcpconn.ReadRequestInfo(r); err == nil {
+		info.TCPInfo = ti
+	}
+	if mode := conf.TelemetryVerification; mode != verificationOff {
+		v := verify(r, clientIP, download, upload, conf.TelemetryVerificationTolerance)
+		if v.Status != verificationVerified && mode == verificationReject {
+			slog.Info("rejected telemetry", slog.String("session", v.Session), slog.Any("reasons", v.Reasons))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		info.Verification = &v
+	}
+	record.ServerInfo = serverInfo(info)
+
 	t := time.Now()
 	entropy := ulid.Monotonic(rand.New(rand.NewSource(t.UnixNano())), 0)
 	uuid := ulid.MustNew(ulid.Timestamp(t), entropy)
@@ -208,6 +249,15 @@ func Record(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func serverInfo(info ServerInfo) string {
+	b, err := json.Marshal(info)
+	if err != nil {
+		slog.Error("encoding server info", slog.Any("error", err))
+		return "{}"
+	}
+	return string(b)
+}
+
 func DrawPNG(w http.ResponseWriter, r *http.Request) {
 	conf := config.LoadedConfig()
 
@@ -0,0 +1,75 @@
+package results
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/librespeed/speedtest/session"
+)
+
+// telemetry_verification modes
+const (
+	verificationOff    = "off"
+	verificationFlag   = "flag"
+	verificationReject = "reject"
+)
+
+// writes return as soon as data is in the socket buffer, so the server can only tell
+// the real rate of transfers lasting well beyond the time it takes to fill it
+const minVerifiableDurationMs = 1000
+
+const (
+	verificationVerified   = "verified"
+	verificationMismatch   = "mismatch"
+	verificationUnverified = "unverified"
+)
+
+// Verification compares a telemetry submission with the transfers of its test session,
+// as seen by the server
+type Verification struct {
+	Session              string   `json:"session,omitempty"`
+	Status               string   `json:"status"`
+	ObservedDownloadMbps float64  `json:"observedDownloadMbps"`
+	ObservedUploadMbps   float64  `json:"observedUploadMbps"`
+	Reasons              []string `json:"reasons,omitempty"`
+}
+
+// verify checks the reported download and upload speeds in Mbit/s against the session's
+// transfers. Reported speeds may exceed the observed ones by the given tolerance, as a fraction.
+func verify(r *http.Request, ip, download, upload string, tolerance float64) Verification {
+	id := r.FormValue("session")
+	ret := Verification{Session: id, Status: verificationVerified}
+	s := session.Get(id)
+	if id == "" || s == nil || s.IP != ip {
+		ret.Status = verificationUnverified
+		ret.Reasons = append(ret.Reasons, "no test session")
+		return ret
+	}
+
+	report := s.Report()
+	ret.ObservedDownloadMbps = report.Download.Mbps
+	ret.ObservedUploadMbps = report.Upload.Mbps
+	check := func(name, value string, dir session.DirectionReport) {
+		if value == "" {
+			return
+		}
+		reported, err := strconv.ParseFloat(value, 64)
+		switch {
+		case err != nil:
+			ret.Reasons = append(ret.Reasons, fmt.Sprintf("invalid %s speed %q", name, value))
+		case reported > 0 && dir.Streams == 0:
+			ret.Reasons = append(ret.Reasons, fmt.Sprintf("%s speed reported without %s transfers", name, name))
+		case reported > 0 && dir.DurationMs < minVerifiableDurationMs:
+			ret.Reasons = append(ret.Reasons, fmt.Sprintf("%s transfers too short to verify", name))
+		case reported > dir.Mbps*(1+tolerance):
+			ret.Reasons = append(ret.Reasons, fmt.Sprintf("%s speed %.2f Mbit/s exceeds observed %.2f Mbit/s", name, reported, dir.Mbps))
+		}
+	}
+	check("download", download, report.Download)
+	check("upload", upload, report.Upload)
+	if len(ret.Reasons) > 0 {
+		ret.Status = verificationMismatch
+	}
+	return ret
+}
@@ -0,0 +1,94 @@
+package results
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database"
+	"github.com/librespeed/speedtest/database/memory"
+	"github.com/librespeed/speedtest/database/schema"
+	"github.com/librespeed/speedtest/session"
+)
+
+func TestVerifiedTelemetry(t *testing.T) {
+	mem, _ := memory.Open(schema.Config{})
+	database.DB = mem
+	conf := config.LoadedConfig()
+	defer func(c config.Config) { *conf = c }(*conf)
+	conf.DatabaseType = "memory"
+	conf.TelemetryRequireToken = false
+	conf.TelemetryVerificationTolerance = 0.5
+
+	const ip = "192.0.2.1"
+	newSession := func(ip string) *session.Session {
+		s, err := session.New(ip)
+		if err != nil {
+			t.Fatalf("creating session: %v", err)
+		}
+		return s
+	}
+	// 1.25 MB over at least a second, at most 10 Mbit/s
+	long := newSession(ip)
+	dl := long.StartTransfer(session.Download)
+	dl.Add(1250000)
+	time.Sleep(1100 * time.Millisecond)
+	dl.Done()
+	short := newSession(ip)
+	tr := short.StartTransfer(session.Download)
+	tr.Add(1250000)
+	tr.Done()
+	other := newSession("198.51.100.1")
+
+	for _, tc := range []struct {
+		name    string
+		session string
+		dl, ul  string
+		status  string
+	}{
+		{"verified", long.ID, "4", "", verificationVerified},
+		{"download mismatch", long.ID, "100", "", verificationMismatch},
+		{"upload without transfers", long.ID, "4", "4", verificationMismatch},
+		{"no session", "", "4", "", verificationUnverified},
+		{"unknown session", "unknown", "4", "", verificationUnverified},
+		{"session of another client", other.ID, "4", "", verificationUnverified},
+		{"too short to verify", short.ID, "4", "", verificationMismatch},
+	} {
+		for _, mode := range []string{verificationFlag, verificationReject} {
+			conf.TelemetryVerification = mode
+			form := url.Values{"session": {tc.session}, "dl": {tc.dl}, "ul": {tc.ul}}
+			req := httptest.NewRequest(http.MethodPost, "/results/telemetry", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = ip + ":1234"
+			w := httptest.NewRecorder()
+			Record(w, req)
+
+			if mode == verificationReject && tc.status != verificationVerified {
+				if w.Code != http.StatusForbidden {
+					t.Errorf("%s, %s: status = %d, want 403", tc.name, mode, w.Code)
+				}
+				continue
+			}
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "id ") {
+				t.Errorf("%s, %s: status = %d, body %q", tc.name, mode, w.Code, w.Body.String())
+				continue
+			}
+			record, err := mem.FetchByUUID(strings.TrimPrefix(w.Body.String(), "id "))
+			if err != nil {
+				t.Fatalf("%s, %s: fetching record: %v", tc.name, mode, err)
+			}
+			var info ServerInfo
+			if err := json.Unmarshal([]byte(record.ServerInfo), &info); err != nil || info.Verification == nil {
+				t.Fatalf("%s, %s: server info = %q, %v", tc.name, mode, record.ServerInfo, err)
+			}
+			if v := info.Verification; v.Status != tc.status {
+				t.Errorf("%s, %s: verification = %+v, want %s", tc.name, mode, v, tc.status)
+			}
+		}
+	}
+}
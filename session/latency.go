@@ -0,0 +1,195 @@
+package session
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Phase of a test while a latency sample was taken
+type Phase int
+
+const (
+	Idle Phase = iota
+	Loaded
+	LoadedDownload
+	LoadedUpload
+)
+
+func (p Phase) String() string {
+	switch p {
+	case Idle:
+		return "idle"
+	case LoadedDownload:
+		return "download"
+	case LoadedUpload:
+		return "upload"
+	default:
+		// downloads and uploads at the same time
+		return "bidirectional"
+	}
+}
+
+func (p Phase) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Phase) UnmarshalText(b []byte) error {
+	for _, v := range []Phase{Idle, Loaded, LoadedDownload, LoadedUpload} {
+		if v.String() == string(b) {
+			*p = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown phase %q", b)
+}
+
+// Sample is a round trip time measured by the client
+type Sample struct {
+	At    time.Time
+	RTT   time.Duration
+	Phase Phase
+}
+
+// LatencyStats summarizes the samples of one phase
+type LatencyStats struct {
+	Samples  int     `json:"samples"`
+	MinMs    float64 `json:"minMs"`
+	MedianMs float64 `json:"medianMs"`
+	P90Ms    float64 `json:"p90Ms"`
+}
+
+// LatencyResult compares latency under load with idle latency
+type LatencyResult struct {
+	Idle               LatencyStats `json:"idle"`
+	Download           LatencyStats `json:"download"`
+	Upload             LatencyStats `json:"upload"`
+	DownloadIncreaseMs float64      `json:"downloadIncreaseMs"`
+	UploadIncreaseMs   float64      `json:"uploadIncreaseMs"`
+	// A+ to F, empty until there are idle and loaded samples
+	Grade string `json:"grade"`
+}
+
+// bufferbloat grades by the largest latency increase under load
+var grades = []struct {
+	below time.Duration
+	grade string
+}{
+	{5 * time.Millisecond, "A+"},
+	{30 * time.Millisecond, "A"},
+	{60 * time.Millisecond, "B"},
+	{200 * time.Millisecond, "C"},
+	{400 * time.Millisecond, "D"},
+}
+
+// Phase returns the current phase, from the transfers running right now
+func (s *Session) Phase() Phase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phase()
+}
+
+func (s *Session) phase() Phase {
+	switch {
+	case s.downloads > 0 && s.uploads > 0:
+		return Loaded
+	case s.downloads > 0:
+		return LoadedDownload
+	case s.uploads > 0:
+		return LoadedUpload
+	default:
+		return Idle
+	}
+}
+
+// Probe registers a latency probe received now, and returns its sequence number and phase.
+// The client reports the probe's round trip time with AddSample once it has the response.
+func (s *Session) Probe() (uint64, Phase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSeq++
+	seq := s.nextSeq
+	p := s.phase()
+	// probes that are never reported don't pile up
+	delete(s.pending, seq-maxPending)
+	s.pending[seq] = p
+	return seq, p
+}
+
+// AddSample records the round trip time of probe seq, in the phase the probe was received in
+func (s *Session) AddSample(seq uint64, rtt time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[seq]
+	if !ok || rtt <= 0 || len(s.samples) >= maxSamples {
+		return false
+	}
+	delete(s.pending, seq)
+	s.samples = append(s.samples, Sample{At: time.Now(), RTT: rtt, Phase: p})
+	return true
+}
+
+// Latency returns the latency statistics and bufferbloat grade of the session
+func (s *Session) Latency() LatencyResult {
+	s.mu.Lock()
+	byPhase := make(map[Phase][]time.Duration)
+	for _, v := range s.samples {
+		byPhase[v.Phase] = append(byPhase[v.Phase], v.RTT)
+	}
+	s.mu.Unlock()
+
+	ret := LatencyResult{
+		Idle:     latencyStats(byPhase[Idle]),
+		Download: latencyStats(byPhase[LoadedDownload]),
+		Upload:   latencyStats(byPhase[LoadedUpload]),
+	}
+	if ret.Idle.Samples == 0 || (ret.Download.Samples == 0 && ret.Upload.Samples == 0) {
+		return ret
+	}
+	if ret.Download.Samples > 0 {
+		ret.DownloadIncreaseMs = max(ret.Download.MedianMs-ret.Idle.MedianMs, 0)
+	}
+	if ret.Upload.Samples > 0 {
+		ret.UploadIncreaseMs = max(ret.Upload.MedianMs-ret.Idle.MedianMs, 0)
+	}
+	ret.Grade = Grade(time.Duration(max(ret.DownloadIncreaseMs, ret.UploadIncreaseMs) * float64(time.Millisecond)))
+	return ret
+}
+
+// Grade returns the bufferbloat grade for the given latency increase under load
+func Grade(increase time.Duration) string {
+	for _, g := range grades {
+		if increase < g.below {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+func latencyStats(rtts []time.Duration) LatencyStats {
+	if len(rtts) == 0 {
+		return LatencyStats{}
+	}
+	slices.Sort(rtts)
+	return LatencyStats{
+		Samples:  len(rtts),
+		MinMs:    ms(rtts[0]),
+		MedianMs: ms(percentile(rtts, 50)),
+		P90Ms:    ms(percentile(rtts, 90)),
+	}
+}
+
+// percentile of sorted durations, interpolating between the closest ranks
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(rank)
+	if lo+1 >= len(sorted) {
+		return sorted[lo]
+	}
+	frac := rank - float64(lo)
+	return sorted[lo] + time.Duration(frac*float64(sorted[lo+1]-sorted[lo]))
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
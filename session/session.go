@@ -0,0 +1,138 @@
+// Package session coordinates the requests of a single speed test, such as latency
+// probes sent while downloads and uploads are running on other connections.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// sessions expire after being unused for this long
+	idleLifetime = 10 * time.Minute
+	// upper limit of latency samples kept per session
+	maxSamples = 10000
+	// upper limit of probes awaiting their round trip time
+	maxPending = 64
+	// limits on live sessions, so that clients can't exhaust memory by creating them
+	maxSessions      = 100000
+	maxSessionsPerIP = 64
+)
+
+var (
+	ErrTooManyForIP = errors.New("too many sessions for the client")
+	ErrTooMany      = errors.New("too many sessions")
+)
+
+// Direction of a transfer
+type Direction int
+
+const (
+	Download Direction = iota
+	Upload
+)
+
+type Session struct {
+	ID string
+	// client IP the session was created by
+	IP      string
+	Created time.Time
+
+	mu        sync.Mutex
+	lastUsed  time.Time
+	downloads int
+	uploads   int
+	nextSeq   uint64
+	pending   map[uint64]Phase
+	samples   []Sample
+	transfers []*Transfer
+}
+
+var (
+	mu        sync.Mutex
+	sessions  = make(map[string]*Session)
+	perIP     = make(map[string]int)
+	lastSweep time.Time
+)
+
+// New creates a session for the client at ip, failing with ErrTooManyForIP or ErrTooMany
+// if the client or the server already has too many live sessions
+func New(ip string) (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("failed to generate session ID: %s", err))
+	}
+	now := time.Now()
+	s := &Session{
+		ID:       hex.EncodeToString(b),
+		IP:       ip,
+		Created:  now,
+		lastUsed: now,
+		pending:  make(map[uint64]Phase),
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// expired sessions are only swept occasionally, so creating sessions doesn't scan all of them
+	if now.Sub(lastSweep) > time.Second {
+		sweep(now)
+	}
+	if perIP[ip] >= maxSessionsPerIP {
+		return nil, ErrTooManyForIP
+	}
+	if len(sessions) >= maxSessions {
+		return nil, ErrTooMany
+	}
+	sessions[s.ID] = s
+	perIP[ip]++
+	return s, nil
+}
+
+// sweep removes expired sessions, mu must be held
+func sweep(now time.Time) {
+	for k, v := range sessions {
+		if v.expired(now) {
+			delete(sessions, k)
+			if perIP[v.IP]--; perIP[v.IP] <= 0 {
+				delete(perIP, v.IP)
+			}
+		}
+	}
+	lastSweep = now
+}
+
+// Get returns the session with the given ID, or nil if it doesn't exist or has expired
+func Get(id string) *Session {
+	mu.Lock()
+	s, ok := sessions[id]
+	mu.Unlock()
+	if !ok || s.expired(time.Now()) {
+		return nil
+	}
+	s.touch()
+	return s
+}
+
+func (s *Session) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// sessions with running transfers stay alive however long they take
+	return s.downloads == 0 && s.uploads == 0 && now.Sub(s.lastUsed) > idleLifetime
+}
+
+func (s *Session) touch() {
+	s.mu.Lock()
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+}
+
+// Expires returns when the session expires if it isn't used again
+func (s *Session) Expires() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastUsed.Add(idleLifetime)
+}
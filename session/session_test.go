@@ -0,0 +1,125 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGrade(t *testing.T) {
+	for _, tc := range []struct {
+		increase time.Duration
+		want     string
+	}{
+		{0, "A+"},
+		{4 * time.Millisecond, "A+"},
+		{5 * time.Millisecond, "A"},
+		{59 * time.Millisecond, "B"},
+		{199 * time.Millisecond, "C"},
+		{399 * time.Millisecond, "D"},
+		{time.Second, "F"},
+	} {
+		if got := Grade(tc.increase); got != tc.want {
+			t.Errorf("Grade(%s) = %s, want %s", tc.increase, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyUnderLoad(t *testing.T) {
+	s, _ := New("192.0.2.1")
+	if Get(s.ID) != s {
+		t.Fatal("session not found")
+	}
+
+	probe := func(rtt time.Duration) {
+		seq, _ := s.Probe()
+		if !s.AddSample(seq, rtt) {
+			t.Fatalf("sample %d rejected", seq)
+		}
+	}
+	for _, ms := range []time.Duration{10, 12, 11} {
+		probe(ms * time.Millisecond)
+	}
+	if got := s.Latency(); got.Grade != "" || got.Idle.Samples != 3 || got.Idle.MedianMs != 11 {
+		t.Fatalf("idle only: %+v", got)
+	}
+
+	dl := s.StartTransfer(Download)
+	if s.Phase() != LoadedDownload {
+		t.Fatalf("phase during download = %s", s.Phase())
+	}
+	for _, ms := range []time.Duration{50, 60, 55} {
+		probe(ms * time.Millisecond)
+	}
+	dl.Done()
+	dl.Done()
+
+	up := s.StartTransfer(Upload)
+	probe(13 * time.Millisecond)
+	up.Done()
+
+	got := s.Latency()
+	if got.Download.MedianMs != 55 || got.Upload.MedianMs != 13 {
+		t.Fatalf("loaded latency: %+v", got)
+	}
+	if got.DownloadIncreaseMs != 44 || got.UploadIncreaseMs != 2 || got.Grade != "B" {
+		t.Fatalf("grade: %+v", got)
+	}
+	if s.Phase() != Idle {
+		t.Fatalf("phase after transfers = %s", s.Phase())
+	}
+}
+
+func TestReport(t *testing.T) {
+	s, _ := New("192.0.2.1")
+	a := s.StartTransfer(Download)
+	b := s.StartTransfer(Download)
+	u := s.StartTransfer(Upload)
+	a.Add(1000)
+	b.Add(3000)
+	a.Done()
+	b.Done()
+	u.Add(500)
+
+	r := s.Report()
+	if d := r.Download; d.Streams != 2 || d.MaxConcurrent != 2 || d.Bytes != 4000 || len(d.Details) != 2 || d.Details[1].Bytes != 3000 {
+		t.Fatalf("download report = %+v", d)
+	}
+	if u := r.Upload; u.Streams != 1 || u.Bytes != 500 || !u.Details[0].Running {
+		t.Fatalf("upload report = %+v", u)
+	}
+	if s.Phase() != LoadedUpload {
+		t.Fatalf("phase = %s", s.Phase())
+	}
+
+	var none *Session
+	none.StartTransfer(Download).Add(1)
+}
+
+func TestSessionLimits(t *testing.T) {
+	const ip = "198.51.100.7"
+	for i := 0; i < maxSessionsPerIP; i++ {
+		if _, err := New(ip); err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+	}
+	if _, err := New(ip); !errors.Is(err, ErrTooManyForIP) {
+		t.Fatalf("over the per-IP limit: %v", err)
+	}
+	if _, err := New("198.51.100.8"); err != nil {
+		t.Fatalf("other client: %v", err)
+	}
+
+	// expired sessions no longer count
+	mu.Lock()
+	for _, s := range sessions {
+		if s.IP == ip {
+			s.lastUsed = time.Now().Add(-2 * idleLifetime)
+		}
+	}
+	lastSweep = time.Time{}
+	mu.Unlock()
+	if _, err := New(ip); err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// upper limit of transfers kept per session
+const maxTransfers = 1024
+
+func (d Direction) String() string {
+	if d == Download {
+		return "download"
+	}
+	return "upload"
+}
+
+// Transfer is a single garbage or empty request of a session
+type Transfer struct {
+	session   *Session
+	direction Direction
+
+	mu    sync.Mutex
+	bytes int64
+	start time.Time
+	end   time.Time
+	done  bool
+}
+
+// Add counts n bytes transferred. Like Done, it does nothing on a nil Transfer,
+// so handlers can use the result of StartTransfer on a nil Session.
+func (t *Transfer) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bytes += n
+	t.mu.Unlock()
+}
+
+// Done marks the transfer as finished, calling it more than once has no effect
+func (t *Transfer) Done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	t.end = time.Now()
+	t.mu.Unlock()
+
+	s := t.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adjustTransfers(t.direction, -1)
+	s.lastUsed = t.end
+}
+
+// StartTransfer marks a transfer in direction d as running until its Done method is called
+func (s *Session) StartTransfer(d Direction) *Transfer {
+	if s == nil {
+		return nil
+	}
+	t := &Transfer{session: s, direction: d, start: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adjustTransfers(d, 1)
+	// the running count is kept regardless, only the report loses streams past the limit
+	if len(s.transfers) < maxTransfers {
+		s.transfers = append(s.transfers, t)
+	}
+	return t
+}
+
+func (s *Session) adjustTransfers(d Direction, n int) {
+	if d == Download {
+		s.downloads += n
+	} else {
+		s.uploads += n
+	}
+}
+
+// StreamReport describes one transfer, times are relative to the session's creation
+type StreamReport struct {
+	Bytes      int64   `json:"bytes"`
+	StartMs    float64 `json:"startMs"`
+	DurationMs float64 `json:"durationMs"`
+	Mbps       float64 `json:"mbps"`
+	Running    bool    `json:"running,omitempty"`
+}
+
+// DirectionReport aggregates the transfers of one direction. The aggregate rate is
+// the total of all streams over the time from the first start to the last end.
+type DirectionReport struct {
+	Streams       int            `json:"streams"`
+	MaxConcurrent int            `json:"maxConcurrent"`
+	Bytes         int64          `json:"bytes"`
+	DurationMs    float64        `json:"durationMs"`
+	Mbps          float64        `json:"mbps"`
+	Details       []StreamReport `json:"details"`
+}
+
+type Report struct {
+	Download DirectionReport `json:"download"`
+	Upload   DirectionReport `json:"upload"`
+}
+
+// Report returns per stream and aggregate throughput of the session's transfers so far
+func (s *Session) Report() Report {
+	s.mu.Lock()
+	transfers := append([]*Transfer(nil), s.transfers...)
+	s.mu.Unlock()
+
+	now := time.Now()
+	var ret Report
+	spans := map[Direction][]span{}
+	for _, t := range transfers {
+		t.mu.Lock()
+		sp := span{start: t.start, end: t.end, bytes: t.bytes, running: !t.done}
+		t.mu.Unlock()
+		if sp.running {
+			sp.end = now
+		}
+		spans[t.direction] = append(spans[t.direction], sp)
+	}
+	ret.Download = s.directionReport(spans[Download])
+	ret.Upload = s.directionReport(spans[Upload])
+	return ret
+}
+
+type span struct {
+	start, end time.Time
+	bytes      int64
+	running    bool
+}
+
+func (s *Session) directionReport(spans []span) DirectionReport {
+	ret := DirectionReport{Streams: len(spans), Details: make([]StreamReport, 0, len(spans))}
+	if len(spans) == 0 {
+		return ret
+	}
+
+	first, last := spans[0].start, spans[0].end
+	for _, sp := range spans {
+		d := sp.end.Sub(sp.start)
+		ret.Details = append(ret.Details, StreamReport{
+			Bytes:      sp.bytes,
+			StartMs:    ms(sp.start.Sub(s.Created)),
+			DurationMs: ms(d),
+			Mbps:       mbps(sp.bytes, d),
+			Running:    sp.running,
+		})
+		ret.Bytes += sp.bytes
+		if sp.start.Before(first) {
+			first = sp.start
+		}
+		if sp.end.After(last) {
+			last = sp.end
+		}
+
+		concurrent := 0
+		for _, other := range spans {
+			if !other.start.After(sp.start) && other.end.After(sp.start) {
+				concurrent++
+			}
+		}
+		ret.MaxConcurrent = max(ret.MaxConcurrent, concurrent)
+	}
+	ret.DurationMs = ms(last.Sub(first))
+	ret.Mbps = mbps(ret.Bytes, last.Sub(first))
+	return ret
+}
+
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes*8) / d.Seconds() / 1e6
+}
@@ -0,0 +1,131 @@
+// Package signed issues and checks values bound to a client's IP address, which expire and
+// can only be used once. Telemetry tokens and proof-of-work challenges are built on it.
+//
+// A value is the base64url encoded expiry time, the caller's data and a random nonce,
+// followed by a dot and the base64url encoded HMAC-SHA256 of those and the client's IP
+// address. The address isn't part of the value itself, it is supplied by the checking side.
+package signed
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const nonceSize = 8
+
+var (
+	ErrMalformed = errors.New("malformed")
+	ErrInvalid   = errors.New("invalid signature")
+	ErrExpired   = errors.New("expired")
+	ErrUsed      = errors.New("already used")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Signer signs values with its secret, and remembers the ones used until they expire
+type Signer struct {
+	secret []byte
+
+	mu        sync.Mutex
+	used      map[[nonceSize]byte]time.Time
+	lastSweep time.Time
+}
+
+// Value is a signed value whose signature and expiry have been checked
+type Value struct {
+	Data    []byte
+	Expires time.Time
+	nonce   [nonceSize]byte
+}
+
+// NewSigner returns a Signer keyed with secret
+func NewSigner(secret []byte) *Signer {
+	return &Signer{
+		secret: secret,
+		used:   make(map[[nonceSize]byte]time.Time),
+	}
+}
+
+// Sign returns a value carrying data for the client at ip, valid until expires
+func (s *Signer) Sign(data []byte, ip string, expires time.Time) string {
+	payload := make([]byte, 8+len(data)+nonceSize)
+	binary.BigEndian.PutUint64(payload, uint64(expires.Unix()))
+	copy(payload[8:], data)
+	if _, err := rand.Read(payload[8+len(data):]); err != nil {
+		panic(fmt.Errorf("failed to generate nonce: %s", err))
+	}
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(s.mac(payload, ip))
+}
+
+// Open checks the signature and expiry of v for the client at ip, its data must be dataSize
+// bytes long. It doesn't mark v as used.
+func (s *Signer) Open(v, ip string, dataSize int, now time.Time) (*Value, error) {
+	p, sig, ok := strings.Cut(v, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+	payload, err := encoding.DecodeString(p)
+	if err != nil || len(payload) != 8+dataSize+nonceSize {
+		return nil, ErrMalformed
+	}
+	mac, err := encoding.DecodeString(sig)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(mac, s.mac(payload, ip)) {
+		return nil, ErrInvalid
+	}
+	ret := &Value{
+		Data:    payload[8 : 8+dataSize],
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(payload)), 0),
+	}
+	if now.After(ret.Expires) {
+		return nil, ErrExpired
+	}
+	copy(ret.nonce[:], payload[8+dataSize:])
+	return ret, nil
+}
+
+// Use marks v as used, or returns ErrUsed if it has been already
+func (s *Signer) Use(v *Value, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// expired nonces are dropped at most once a second, so that checks don't scan them all
+	if now.Sub(s.lastSweep) > time.Second {
+		for k, expires := range s.used {
+			if now.After(expires) {
+				delete(s.used, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if _, ok := s.used[v.nonce]; ok {
+		return ErrUsed
+	}
+	s.used[v.nonce] = v.Expires
+	return nil
+}
+
+func (s *Signer) mac(payload []byte, ip string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write(payload)
+	h.Write([]byte(ip))
+	return h.Sum(nil)
+}
+
+// RandomSecret returns a new secret, for signers without a configured one
+func RandomSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("failed to generate secret: %s", err))
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package signed
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s := NewSigner([]byte("secret"))
+	now := time.Now()
+	v := s.Sign([]byte{42}, "192.0.2.1", now.Add(time.Minute))
+
+	for _, tc := range []struct {
+		name     string
+		signer   *Signer
+		v        string
+		ip       string
+		dataSize int
+		now      time.Time
+		want     error
+	}{
+		{"other client", s, v, "198.51.100.1", 1, now, ErrInvalid},
+		{"other secret", NewSigner([]byte("other")), v, "192.0.2.1", 1, now, ErrInvalid},
+		{"expired", s, v, "192.0.2.1", 1, now.Add(2 * time.Minute), ErrExpired},
+		{"tampered signature", s, v[:len(v)-2] + "xx", "192.0.2.1", 1, now, ErrInvalid},
+		{"other data size", s, v, "192.0.2.1", 0, now, ErrMalformed},
+		{"malformed", s, "garbage", "192.0.2.1", 1, now, ErrMalformed},
+	} {
+		if _, err := tc.signer.Open(tc.v, tc.ip, tc.dataSize, tc.now); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	opened, err := s.Open(v, "192.0.2.1", 1, now)
+	if err != nil || !bytes.Equal(opened.Data, []byte{42}) || opened.Expires.Unix() != now.Add(time.Minute).Unix() {
+		t.Fatalf("Open = %+v, %v", opened, err)
+	}
+	if err := s.Use(opened, now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.Use(opened, now); !errors.Is(err, ErrUsed) {
+		t.Errorf("second use: %v", err)
+	}
+
+	// used nonces are forgotten once their value has expired
+	later := now.Add(2 * time.Minute)
+	next, _ := s.Open(s.Sign(nil, "192.0.2.1", later.Add(time.Minute)), "192.0.2.1", 0, later)
+	if err := s.Use(next, later); err != nil {
+		t.Fatalf("later value: %v", err)
+	}
+	if len(s.used) != 1 {
+		t.Errorf("%d nonces kept", len(s.used))
+	}
+}
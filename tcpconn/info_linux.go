@@ -0,0 +1,51 @@
+package tcpconn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func readInfo(c net.Conn) (*Info, error) {
+	var ti *unix.TCPInfo
+	if err := control(c, func(fd int) error {
+		var err error
+		ti, err = unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &Info{
+		State:         ti.State,
+		CAState:       ti.Ca_state,
+		Retransmits:   ti.Retransmits,
+		RTO:           ti.Rto,
+		SndMSS:        ti.Snd_mss,
+		RcvMSS:        ti.Rcv_mss,
+		Unacked:       ti.Unacked,
+		Lost:          ti.Lost,
+		Retrans:       ti.Retrans,
+		PMTU:          ti.Pmtu,
+		RTT:           ti.Rtt,
+		RTTVar:        ti.Rttvar,
+		SndSsThresh:   ti.Snd_ssthresh,
+		SndCwnd:       ti.Snd_cwnd,
+		AdvMSS:        ti.Advmss,
+		RcvRTT:        ti.Rcv_rtt,
+		TotalRetrans:  ti.Total_retrans,
+		PacingRate:    ti.Pacing_rate,
+		MaxPacingRate: ti.Max_pacing_rate,
+		BytesAcked:    ti.Bytes_acked,
+		BytesReceived: ti.Bytes_received,
+		SegsOut:       ti.Segs_out,
+		SegsIn:        ti.Segs_in,
+		MinRTT:        ti.Min_rtt,
+		DeliveryRate:  ti.Delivery_rate,
+		BusyTime:      ti.Busy_time,
+		RWndLimited:   ti.Rwnd_limited,
+		SndBufLimited: ti.Sndbuf_limited,
+		BytesSent:     ti.Bytes_sent,
+		BytesRetrans:  ti.Bytes_retrans,
+	}, nil
+}
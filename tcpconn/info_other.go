@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tcpconn
+
+import (
+	"net"
+)
+
+func readInfo(_ net.Conn) (*Info, error) {
+	return nil, ErrUnsupported
+}
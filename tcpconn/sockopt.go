@@ -0,0 +1,39 @@
+package tcpconn
+
+import (
+	"net"
+)
+
+// ListenerOptions are applied to the listening socket, accepted connections inherit them
+type ListenerOptions struct {
+	// TCP congestion control algorithm, such as cubic, reno or bbr. Empty keeps the system default
+	CongestionControl string
+	// SO_SNDBUF and SO_RCVBUF in bytes, 0 keeps the system default and autotuning
+	SendBuffer    int
+	ReceiveBuffer int
+}
+
+// ConfigureListener applies opts to l
+func ConfigureListener(l net.Listener, opts ListenerOptions) error {
+	if opts == (ListenerOptions{}) {
+		return nil
+	}
+	return configureListener(l, opts)
+}
+
+// CongestionControl returns the congestion control algorithm currently used by c
+func CongestionControl(c net.Conn) (string, error) {
+	if c == nil {
+		return "", ErrUnsupported
+	}
+	return congestionControl(Unwrap(c))
+}
+
+// SetCongestionControl switches c to another congestion control algorithm.
+// Unprivileged processes can only choose from net.ipv4.tcp_allowed_congestion_control.
+func SetCongestionControl(c net.Conn, name string) error {
+	if c == nil {
+		return ErrUnsupported
+	}
+	return setCongestionControl(Unwrap(c), name)
+}
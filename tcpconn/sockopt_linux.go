@@ -0,0 +1,65 @@
+package tcpconn
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control runs fn on the file descriptor of v, which must be a syscall.Conn
+func control(v any, fn func(fd int) error) error {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return ErrUnsupported
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func configureListener(l net.Listener, opts ListenerOptions) error {
+	return control(l, func(fd int) error {
+		if opts.CongestionControl != "" {
+			if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, opts.CongestionControl); err != nil {
+				return fmt.Errorf("setting congestion control %q: %w", opts.CongestionControl, err)
+			}
+		}
+		if opts.SendBuffer > 0 {
+			if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+				return fmt.Errorf("setting send buffer size: %w", err)
+			}
+		}
+		if opts.ReceiveBuffer > 0 {
+			if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+				return fmt.Errorf("setting receive buffer size: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func congestionControl(c net.Conn) (string, error) {
+	var name string
+	err := control(c, func(fd int) error {
+		var err error
+		name, err = unix.GetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+		return err
+	})
+	return name, err
+}
+
+func setCongestionControl(c net.Conn, name string) error {
+	return control(c, func(fd int) error {
+		return unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, name)
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tcpconn
+
+import (
+	"net"
+)
+
+func configureListener(_ net.Listener, _ ListenerOptions) error {
+	return ErrUnsupported
+}
+
+func congestionControl(_ net.Conn) (string, error) {
+	return "", ErrUnsupported
+}
+
+func setCongestionControl(_ net.Conn, _ string) error {
+	return ErrUnsupported
+}
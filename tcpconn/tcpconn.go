@@ -0,0 +1,90 @@
+// Package tcpconn reads kernel TCP state from connections accepted by the web server.
+package tcpconn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+type connKey struct{}
+
+// ErrUnsupported is returned on platforms without TCP_INFO, or for connections that aren't TCP
+var ErrUnsupported = errors.New("TCP_INFO is not supported for this connection")
+
+// Info is a subset of the kernel's struct tcp_info. Field names follow the TCPInfo
+// object of NDT7 measurements: times are in microseconds, rates in bytes per second.
+type Info struct {
+	State         uint8  `json:"State"`
+	CAState       uint8  `json:"CAState"`
+	Retransmits   uint8  `json:"Retransmits"`
+	RTO           uint32 `json:"RTO"`
+	SndMSS        uint32 `json:"SndMSS"`
+	RcvMSS        uint32 `json:"RcvMSS"`
+	Unacked       uint32 `json:"Unacked"`
+	Lost          uint32 `json:"Lost"`
+	Retrans       uint32 `json:"Retrans"`
+	PMTU          uint32 `json:"PMTU"`
+	RTT           uint32 `json:"RTT"`
+	RTTVar        uint32 `json:"RTTVar"`
+	SndSsThresh   uint32 `json:"SndSsThresh"`
+	SndCwnd       uint32 `json:"SndCwnd"`
+	AdvMSS        uint32 `json:"AdvMSS"`
+	RcvRTT        uint32 `json:"RcvRTT"`
+	TotalRetrans  uint32 `json:"TotalRetrans"`
+	PacingRate    uint64 `json:"PacingRate"`
+	MaxPacingRate uint64 `json:"MaxPacingRate"`
+	BytesAcked    uint64 `json:"BytesAcked"`
+	BytesReceived uint64 `json:"BytesReceived"`
+	SegsOut       uint32 `json:"SegsOut"`
+	SegsIn        uint32 `json:"SegsIn"`
+	MinRTT        uint32 `json:"MinRTT"`
+	DeliveryRate  uint64 `json:"DeliveryRate"`
+	BusyTime      uint64 `json:"BusyTime"`
+	RWndLimited   uint64 `json:"RWndLimited"`
+	SndBufLimited uint64 `json:"SndBufLimited"`
+	BytesSent     uint64 `json:"BytesSent"`
+	BytesRetrans  uint64 `json:"BytesRetrans"`
+}
+
+// Unwrap returns the connection underneath TLS and proxy protocol wrappers
+func Unwrap(c net.Conn) net.Conn {
+	for {
+		switch v := c.(type) {
+		// *tls.Conn
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		// *proxyproto.Conn
+		case interface{ Raw() net.Conn }:
+			c = v.Raw()
+		default:
+			return c
+		}
+	}
+}
+
+// ConnContext is meant for http.Server.ConnContext, it stores the accepted connection
+// so handlers can reach it with FromRequest
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// FromRequest returns the connection r was received on, or nil if it wasn't stored by ConnContext
+func FromRequest(r *http.Request) net.Conn {
+	c, _ := r.Context().Value(connKey{}).(net.Conn)
+	return c
+}
+
+// ReadInfo returns the current TCP_INFO of c
+func ReadInfo(c net.Conn) (*Info, error) {
+	if c == nil {
+		return nil, ErrUnsupported
+	}
+	return readInfo(Unwrap(c))
+}
+
+// ReadRequestInfo returns the current TCP_INFO of the connection r was received on
+func ReadRequestInfo(r *http.Request) (*Info, error) {
+	return ReadInfo(FromRequest(r))
+}
@@ -0,0 +1,76 @@
+// Package token issues and verifies HMAC signed, time limited and single use test tokens,
+// so that telemetry can only be submitted by clients that actually started a test.
+//
+// Tokens are signed values without data of their own, see package signed for their format.
+package token
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/signed"
+)
+
+var (
+	ErrMalformed = signed.ErrMalformed
+	ErrInvalid   = signed.ErrInvalid
+	ErrExpired   = signed.ErrExpired
+	ErrUsed      = signed.ErrUsed
+)
+
+type Signer struct {
+	signer *signed.Signer
+	ttl    time.Duration
+}
+
+// NewSigner returns a Signer issuing tokens valid for ttl
+func NewSigner(secret []byte, ttl time.Duration) *Signer {
+	return &Signer{
+		signer: signed.NewSigner(secret),
+		ttl:    ttl,
+	}
+}
+
+// signer is replaced by Initialize, until then tokens are signed with a random secret
+var signer = NewSigner(signed.RandomSecret(), time.Hour)
+
+// Initialize sets up the signer used by Issue and Verify from the configuration.
+// Without telemetry_token_secret a random secret is used, so tokens issued before a
+// restart can't be submitted after it.
+func Initialize(conf *config.Config) {
+	secret := []byte(conf.TelemetryTokenSecret)
+	if len(secret) == 0 {
+		slog.Info("telemetry_token_secret is not set, using a random secret")
+		secret = signed.RandomSecret()
+	}
+	ttl := conf.TelemetryTokenTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	signer = NewSigner(secret, ttl)
+}
+
+// Issue returns a token for the client at ip, using the configured signer
+func Issue(ip string) string {
+	return signer.Issue(ip, time.Now())
+}
+
+// Verify checks a token presented by the client at ip, using the configured signer
+func Verify(token, ip string) error {
+	return signer.Verify(token, ip, time.Now())
+}
+
+// Issue returns a token for the client at ip, valid from now until the signer's TTL has passed
+func (s *Signer) Issue(ip string, now time.Time) string {
+	return s.signer.Sign(nil, ip, now.Add(s.ttl))
+}
+
+// Verify checks the signature and expiry of token for the client at ip, and marks it as used
+func (s *Signer) Verify(token, ip string, now time.Time) error {
+	v, err := s.signer.Open(token, ip, 0, now)
+	if err != nil {
+		return err
+	}
+	return s.signer.Use(v, now)
+}
@@ -0,0 +1,36 @@
+package token
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s := NewSigner([]byte("secret"), time.Minute)
+	now := time.Now()
+	tok := s.Issue("192.0.2.1", now)
+
+	if err := s.Verify(tok, "198.51.100.1", now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other client: %v", err)
+	}
+	if err := NewSigner([]byte("other"), time.Minute).Verify(tok, "192.0.2.1", now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other secret: %v", err)
+	}
+	if err := s.Verify(tok, "192.0.2.1", now.Add(2*time.Minute)); !errors.Is(err, ErrExpired) {
+		t.Errorf("expired: %v", err)
+	}
+	if err := s.Verify(tok[:len(tok)-2]+"xx", "192.0.2.1", now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("tampered signature: %v", err)
+	}
+	if err := s.Verify("garbage", "192.0.2.1", now); !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed: %v", err)
+	}
+
+	if err := s.Verify(tok, "192.0.2.1", now); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if err := s.Verify(tok, "192.0.2.1", now); !errors.Is(err, ErrUsed) {
+		t.Errorf("reused: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/librespeed/speedtest/config"
+)
+
+const (
+	// waiting clients are dropped from the queue if they neither poll nor retry for this long
+	queueEntryTimeout = 30 * time.Second
+	// initial estimate of how long a test takes, refined as tests finish
+	defaultTestDuration = 30 * time.Second
+	// clients beyond this are told to come back later without being queued
+	maxQueueLength = 1000
+)
+
+// testAdmission limits the number of clients running tests at the same time, so they don't
+// split the bandwidth of the server between them. A client holds a slot from its first
+// request to a test endpoint until it has been idle for a while, and clients over the
+// limit wait in a queue.
+type testAdmission struct {
+	max  int
+	idle time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*testSlot
+	queue []*queueEntry
+	// the same entries by IP
+	queued map[string]*queueEntry
+	// moving average of how long clients held a slot
+	avgDuration time.Duration
+}
+
+type testSlot struct {
+	started    time.Time
+	lastActive time.Time
+	// requests in flight
+	active int
+}
+
+type queueEntry struct {
+	ip       string
+	lastSeen time.Time
+	// index in the queue
+	index int
+}
+
+// busyResponse tells clients whether they may start testing, and if not their position in
+// the queue and roughly how long they will have to wait
+type busyResponse struct {
+	Busy     bool `json:"busy"`
+	Position int  `json:"position,omitempty"`
+	// seconds
+	EstimatedWait float64 `json:"estimatedWait,omitempty"`
+}
+
+// newTestAdmission returns nil if max_concurrent_tests isn't set
+func newTestAdmission(conf *config.Config) *testAdmission {
+	if conf.MaxConcurrentTests <= 0 {
+		return nil
+	}
+	return &testAdmission{
+		max:         conf.MaxConcurrentTests,
+		idle:        conf.TestIdleTimeout,
+		slots:       make(map[string]*testSlot),
+		queued:      make(map[string]*queueEntry),
+		avgDuration: defaultTestDuration,
+	}
+}
+
+// Handler answers 503 with a busyResponse to clients that can't get a slot.
+// A nil testAdmission lets all requests through.
+func (a *testAdmission) Handler(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		status := a.admit(ip, time.Now(), true)
+		if status.Busy {
+			writeBusy(w, r, status)
+			return
+		}
+		defer a.release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Poll returns the queue position of the client, and admits it once a slot is free.
+// Clients waiting in the queue should poll this every few seconds to keep their place.
+func (a *testAdmission) Poll(w http.ResponseWriter, r *http.Request) {
+	if a == nil {
+		render.JSON(w, r, busyResponse{})
+		return
+	}
+	status := a.admit(remoteIP(r), time.Now(), false)
+	if status.Busy {
+		writeBusy(w, r, status)
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+func writeBusy(w http.ResponseWriter, r *http.Request, status busyResponse) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(status.EstimatedWait)), 1)))
+	render.Status(r, http.StatusServiceUnavailable)
+	render.JSON(w, r, status)
+}
+
+// admit gives the client at ip a slot if it has one already, or if one is free and no one
+// queued before it is waiting for it. Otherwise the client is queued. If request is true,
+// the caller must call release once the request is done.
+func (a *testAdmission) admit(ip string, now time.Time, request bool) busyResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire(now)
+
+	if s, ok := a.slots[ip]; ok {
+		s.lastActive = now
+		if request {
+			s.active++
+		}
+		return busyResponse{}
+	}
+
+	free := a.max - len(a.slots)
+	e, ok := a.queued[ip]
+	if !ok {
+		if len(a.queue) >= maxQueueLength {
+			position := len(a.queue) - free + 1
+			return busyResponse{
+				Busy:          true,
+				Position:      position,
+				EstimatedWait: a.estimateWait(position, now).Seconds(),
+			}
+		}
+		e = &queueEntry{ip: ip, index: len(a.queue)}
+		a.queue = append(a.queue, e)
+		a.queued[ip] = e
+	}
+	e.lastSeen = now
+	if e.index < free {
+		a.dequeue(func(q *queueEntry) bool { return q == e })
+		s := &testSlot{started: now, lastActive: now}
+		if request {
+			s.active++
+		}
+		a.slots[ip] = s
+		return busyResponse{}
+	}
+
+	position := e.index - free + 1
+	return busyResponse{
+		Busy:          true,
+		Position:      position,
+		EstimatedWait: a.estimateWait(position, now).Seconds(),
+	}
+}
+
+// dequeue removes the entries for which del returns true, a.mu must be held
+func (a *testAdmission) dequeue(del func(*queueEntry) bool) {
+	a.queue = slices.DeleteFunc(a.queue, func(e *queueEntry) bool {
+		if del(e) {
+			delete(a.queued, e.ip)
+			return true
+		}
+		return false
+	})
+	for i, e := range a.queue {
+		e.index = i
+	}
+}
+
+// release marks the end of a request of the client at ip
+func (a *testAdmission) release(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.slots[ip]; ok {
+		s.active--
+		s.lastActive = time.Now()
+	}
+}
+
+// expire frees the slots of clients that have been idle for too long and drops clients
+// that stopped waiting from the queue, a.mu must be held
+func (a *testAdmission) expire(now time.Time) {
+	for ip, s := range a.slots {
+		if s.active == 0 && now.Sub(s.lastActive) > a.idle {
+			delete(a.slots, ip)
+			// the idle time at the end isn't part of the test
+			d := s.lastActive.Sub(s.started)
+			a.avgDuration = (a.avgDuration*7 + d) / 8
+		}
+	}
+	a.dequeue(func(e *queueEntry) bool {
+		return now.Sub(e.lastSeen) > queueEntryTimeout
+	})
+}
+
+// estimateWait guesses when the client at the given queue position gets a slot, assuming
+// running tests take as long as the average, a.mu must be held
+func (a *testAdmission) estimateWait(position int, now time.Time) time.Duration {
+	remaining := make([]time.Duration, 0, a.max)
+	for _, s := range a.slots {
+		remaining = append(remaining, max(a.avgDuration-now.Sub(s.started), 0)+a.idle)
+	}
+	// free slots go to clients further up the queue
+	for len(remaining) < a.max {
+		remaining = append(remaining, a.avgDuration+a.idle)
+	}
+	slices.Sort(remaining)
+	round := (position - 1) / a.max
+	return remaining[(position-1)%a.max] + time.Duration(round)*(a.avgDuration+a.idle)
+}
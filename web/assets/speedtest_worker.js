@@ -49,6 +49,7 @@ var settings = {
 	url_ul: "backend/empty.php", // path to an empty file, used for upload test. must be relative to this js file
 	url_ping: "backend/empty.php", // path to an empty file, used for ping test. must be relative to this js file
 	url_getIp: "backend/getIP.php", // path to getIP.php relative to this js file, or a similar thing that outputs the client's ip
+	url_pow: "", // path to the proof-of-work challenge endpoint relative to this js file, defaults to pow/challenge next to url_dl. used when the server requires proof-of-work for downloads
 	getIp_ispInfo: true, //if set to true, the server will include ISP info with the IP address
 	getIp_ispInfo_distance: "km", //km or mi=estimate distance from server in km/mi; set to false to disable distance estimation. getIp_ispInfo must be enabled in order for this to work
 	xhr_dlMultistream: 6, // number of download streams to use (can be different if enable_quirks is active)
@@ -291,6 +292,126 @@ function clearRequests() {
 // gets client's IP using url_getIp, then calls the done function
 var ipCalled = false; // used to prevent multiple accidental calls to getIp
 var ispInfo = ""; //used for telemetry
+var testSession = ""; // test session sent by getIP when the server verifies telemetry, attached to download, upload and telemetry requests
+var testToken = ""; // signed token sent by getIP, proves to the telemetry endpoint that a test was started
+function sessionParam() {
+	return testSession ? "session=" + encodeURIComponent(testSession) + "&" : "";
+}
+// proof-of-work: when the server answers a download with 403, the client has used up its download budget and
+// has to solve a challenge to pay for more. a solution is a string s such that SHA-256(challenge + ":" + s)
+// starts with the requested number of zero bits
+var sha256K = [
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+];
+// SHA-256 of an ASCII string, returned as 8 32-bit words
+function sha256(s) {
+	var len = s.length,
+		blocks = ((len + 8) >> 6) + 1,
+		w = [],
+		i;
+	for (i = 0; i < blocks * 16; i++) w[i] = 0;
+	for (i = 0; i < len; i++) w[i >> 2] |= (s.charCodeAt(i) & 0xff) << (24 - (i & 3) * 8);
+	w[len >> 2] |= 0x80 << (24 - (len & 3) * 8);
+	w[blocks * 16 - 1] = len * 8;
+	var h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19],
+		m = [];
+	for (var off = 0; off < w.length; off += 16) {
+		for (i = 0; i < 16; i++) m[i] = w[off + i];
+		for (i = 16; i < 64; i++) {
+			var x = m[i - 15],
+				y = m[i - 2];
+			var s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+			var s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+			m[i] = (m[i - 16] + s0 + m[i - 7] + s1) | 0;
+		}
+		var a = h[0],
+			b = h[1],
+			c = h[2],
+			d = h[3],
+			e = h[4],
+			f = h[5],
+			g = h[6],
+			k = h[7];
+		for (i = 0; i < 64; i++) {
+			var t1 = (k + (((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7))) + ((e & f) ^ (~e & g)) + sha256K[i] + m[i]) | 0;
+			var t2 = ((((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10))) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+			k = g;
+			g = f;
+			f = e;
+			e = (d + t1) | 0;
+			d = c;
+			c = b;
+			b = a;
+			a = (t1 + t2) | 0;
+		}
+		h[0] = (h[0] + a) | 0;
+		h[1] = (h[1] + b) | 0;
+		h[2] = (h[2] + c) | 0;
+		h[3] = (h[3] + d) | 0;
+		h[4] = (h[4] + e) | 0;
+		h[5] = (h[5] + f) | 0;
+		h[6] = (h[6] + g) | 0;
+		h[7] = (h[7] + k) | 0;
+	}
+	return h;
+}
+function leadingZeroBits(h) {
+	var n = 0;
+	for (var i = 0; i < h.length; i++) {
+		if (h[i] === 0) {
+			n += 32;
+			continue;
+		}
+		for (var v = h[i]; (v & 0x80000000) === 0; v <<= 1) n++;
+		break;
+	}
+	return n;
+}
+// finds a solution in batches, so that the worker keeps answering status requests
+function solvePoW(challenge, difficulty, done) {
+	var n = 0;
+	var batch = function() {
+		for (var end = n + 10000; n < end; n++) {
+			if (leadingZeroBits(sha256(challenge + ":" + n)) >= difficulty) {
+				done("" + n);
+				return;
+			}
+		}
+		setTimeout(batch, 0);
+	};
+	batch();
+}
+// gets and solves a challenge, then calls done with the query parameters carrying the solution, or "" if that failed
+function getPoW(done) {
+	var url = settings.url_pow || settings.url_dl.replace(/[^\/]*$/, "pow/challenge");
+	var startT = new Date().getTime();
+	var x = new XMLHttpRequest();
+	x.onload = function() {
+		try {
+			var c = JSON.parse(x.responseText);
+			solvePoW(c.challenge, c.difficulty, function(solution) {
+				tlog("proof-of-work solved, difficulty " + c.difficulty + ", took " + (new Date().getTime() - startT) + "ms");
+				done("pow=" + encodeURIComponent(c.challenge) + "&powSolution=" + solution + "&");
+			});
+		} catch (e) {
+			twarn("Invalid proof-of-work challenge: " + x.responseText);
+			done("");
+		}
+	};
+	x.onerror = function() {
+		twarn("Getting proof-of-work challenge failed");
+		done("");
+	};
+	x.open("GET", url + url_sep(url) + (settings.mpot ? "cors=true&" : "") + "r=" + Math.random(), true);
+	x.send();
+}
 function getIp(done) {
 	tverb("getIp");
 	if (ipCalled) return;
@@ -303,6 +424,8 @@ function getIp(done) {
 			var data = JSON.parse(xhr.responseText);
 			clientIp = data.processedString;
 			ispInfo = data.rawIspInfo;
+			testSession = data.session || "";
+			testToken = data.token || "";
 		} catch (e) {
 			clientIp = xhr.responseText;
 			ispInfo = "";
@@ -329,7 +452,7 @@ function dlTest(done) {
 		failed = false; // set to true if a stream fails
 	xhr = [];
 	// function to create a download stream. streams are slightly delayed so that they will not end at the same time
-	var testStream = function(i, delay) {
+	var testStream = function(i, delay, powParams) {
 		setTimeout(
 			function() {
 				if (testState !== 1) return; // delayed stream ended up starting after the end of the download test
@@ -351,6 +474,21 @@ function dlTest(done) {
 					prevLoaded = event.loaded;
 				}.bind(this);
 				xhr[i].onload = function() {
+					if (x.status === 403) {
+						// the server requires proof-of-work for more data
+						tverb("dl stream needs proof-of-work " + i);
+						if (powParams) {
+							// the solution was refused, trying again would not help
+							failed = true;
+							return;
+						}
+						getPoW(function(p) {
+							if (testState !== 1) return;
+							if (p) testStream(i, 0, p);
+							else failed = true;
+						});
+						return;
+					}
 					// the large file has been loaded entirely, start again
 					tverb("dl stream finished " + i);
 					try {
@@ -373,7 +511,7 @@ function dlTest(done) {
 					if (settings.xhr_dlUseBlob) xhr[i].responseType = "blob";
 					else xhr[i].responseType = "arraybuffer";
 				} catch (e) {}
-				xhr[i].open("GET", settings.url_dl + url_sep(settings.url_dl) + (settings.mpot ? "cors=true&" : "") + "r=" + Math.random() + "&ckSize=" + settings.garbagePhp_chunkSize, true); // random string to prevent caching
+				xhr[i].open("GET", settings.url_dl + url_sep(settings.url_dl) + (settings.mpot ? "cors=true&" : "") + sessionParam() + (powParams || "") + "r=" + Math.random() + "&ckSize=" + settings.garbagePhp_chunkSize, true); // random string to prevent caching
 				xhr[i].send();
 			}.bind(this),
 			1 + delay
@@ -455,7 +593,7 @@ function ulTest(done) {
 			failed = false; // set to true if a stream fails
 		xhr = [];
 		// function to create an upload stream. streams are slightly delayed so that they will not end at the same time
-		var testStream = function(i, delay) {
+		var testStream = function(i, delay, powParams) {
 			setTimeout(
 				function() {
 					if (testState !== 3) return; // delayed stream ended up starting after the end of the upload test
@@ -480,7 +618,7 @@ function ulTest(done) {
 							totLoaded += reqsmall.size;
 							testStream(i, 0);
 						};
-						xhr[i].open("POST", settings.url_ul + url_sep(settings.url_ul) + (settings.mpot ? "cors=true&" : "") + "r=" + Math.random(), true); // random string to prevent caching
+						xhr[i].open("POST", settings.url_ul + url_sep(settings.url_ul) + (settings.mpot ? "cors=true&" : "") + sessionParam() + "r=" + Math.random(), true); // random string to prevent caching
 						try {
 							xhr[i].setRequestHeader("Content-Encoding", "identity"); // disable compression (some browsers may refuse it, but data is incompressible anyway)
 						} catch (e) {}
@@ -516,7 +654,7 @@ function ulTest(done) {
 							if (settings.xhr_ignoreErrors === 1) testStream(i, 0); //restart stream
 						}.bind(this);
 						// send xhr
-						xhr[i].open("POST", settings.url_ul + url_sep(settings.url_ul) + (settings.mpot ? "cors=true&" : "") + "r=" + Math.random(), true); // random string to prevent caching
+						xhr[i].open("POST", settings.url_ul + url_sep(settings.url_ul) + (settings.mpot ? "cors=true&" : "") + sessionParam() + "r=" + Math.random(), true); // random string to prevent caching
 						try {
 							xhr[i].setRequestHeader("Content-Encoding", "identity"); // disable compression (some browsers may refuse it, but data is incompressible anyway)
 						} catch (e) {}
@@ -715,9 +853,11 @@ function sendTelemetry(done) {
 		fd.append("jitter", jitterStatus);
 		fd.append("log", settings.telemetry_level > 1 ? log : "");
 		fd.append("extra", settings.telemetry_extra);
+		fd.append("session", testSession);
+		fd.append("token", testToken);
 		xhr.send(fd);
 	} catch (ex) {
-		var postData = "extra=" + encodeURIComponent(settings.telemetry_extra) + "&ispinfo=" + encodeURIComponent(JSON.stringify(telemetryIspInfo)) + "&dl=" + encodeURIComponent(dlStatus) + "&ul=" + encodeURIComponent(ulStatus) + "&ping=" + encodeURIComponent(pingStatus) + "&jitter=" + encodeURIComponent(jitterStatus) + "&log=" + encodeURIComponent(settings.telemetry_level > 1 ? log : "");
+		var postData = "extra=" + encodeURIComponent(settings.telemetry_extra) + "&ispinfo=" + encodeURIComponent(JSON.stringify(telemetryIspInfo)) + "&dl=" + encodeURIComponent(dlStatus) + "&ul=" + encodeURIComponent(ulStatus) + "&ping=" + encodeURIComponent(pingStatus) + "&jitter=" + encodeURIComponent(jitterStatus) + "&log=" + encodeURIComponent(settings.telemetry_level > 1 ? log : "") + "&session=" + encodeURIComponent(testSession) + "&token=" + encodeURIComponent(testToken);
 		xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
 		xhr.send(postData);
 	}
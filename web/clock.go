@@ -0,0 +1,59 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timestampsResponse carries the timestamps of an NTP style exchange, in Unix nanoseconds
+type timestampsResponse struct {
+	// client send time, echoed from ?t1=
+	T1 int64 `json:"t1"`
+	// server receive time
+	T2 int64 `json:"t2"`
+	// server send time
+	T3 int64 `json:"t3"`
+}
+
+// timestamps answers with the server's receive and send times, so that with its own
+// send time t1 and receive time t4 the client can estimate, like NTP:
+//
+//	clock offset     = ((t2 - t1) + (t3 - t4)) / 2
+//	round trip delay = (t4 - t1) - (t3 - t2)
+//
+// The offset assumes both directions take the same time, so applying it to the exchange it
+// came from always splits the round trip in two halves. To see asymmetry, clients take the
+// offset from another exchange, the one with the smallest round trip delay out of several,
+// or rely on clocks synchronized by other means, and compute for each exchange:
+//
+//	upstream delay   = t2 - t1 - offset
+//	downstream delay = t4 - t3 + offset
+//
+// Any error in the offset moves both by the same amount in opposite directions, so with an
+// estimated offset these show how one-way delays vary over the test, not their actual values.
+func timestamps(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+
+	var t1 int64
+	if v := r.FormValue("t1"); v != "" {
+		var err error
+		if t1, err = strconv.ParseInt(v, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ret := timestampsResponse{
+		T1: t1,
+		T2: received.UnixNano(),
+		// taken last, right before the response is written
+		T3: time.Now().UnixNano(),
+	}
+	if err := json.NewEncoder(w).Encode(ret); err != nil {
+		slog.Debug("writing timestamps", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/tcpconn"
+)
+
+const congestionControlHeader = "X-Congestion-Control"
+
+// congestionControl switches the connection to the algorithm requested with ?cc=<name> for
+// the duration of the request. Only algorithms in tcp_allowed_congestion_controls are accepted.
+//
+// The setting applies to the whole connection, so tests comparing algorithms should not
+// share an HTTP/2 connection between requests using different ones.
+func congestionControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("cc")
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !slices.Contains(config.LoadedConfig().TCPAllowedCongestionControls, name) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn := tcpconn.FromRequest(r)
+		prev, err := tcpconn.CongestionControl(conn)
+		if err == nil {
+			err = tcpconn.SetCongestionControl(conn, name)
+		}
+		if err != nil {
+			slog.Debug("setting congestion control", slog.String("name", name), slog.Any("error", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// keep-alive connections go back to the listener's algorithm for the next request
+		defer func() {
+			if prev != name {
+				_ = tcpconn.SetCongestionControl(conn, prev)
+			}
+		}()
+
+		w.Header().Set(congestionControlHeader, name)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,260 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/librespeed/speedtest/session"
+)
+
+const (
+	testFileChecksums = "SHA256SUMS"
+	testFileExt       = ".bin"
+	// largest test file that can be configured
+	testFileMaxSize = 100 << 30
+)
+
+// testFile is a pseudo-random file generated on the fly. The content only depends on the
+// name: it is the AES-128-CTR keystream keyed by the first 16 bytes of the SHA-256 of the name,
+// starting at a zero counter, so it's identical across restarts and servers.
+type testFile struct {
+	name string
+	size int64
+	key  []byte
+	etag string
+
+	// set by hashTestFiles, nil until then
+	checksum atomic.Pointer[string]
+}
+
+// testFiles is set up by ListenAndServe from test_files
+var testFiles map[string]*testFile
+
+// newTestFiles parses sizes like "100MB" into files named like "100MB.bin"
+func newTestFiles(sizes []string) (map[string]*testFile, error) {
+	ret := make(map[string]*testFile, len(sizes))
+	for _, s := range sizes {
+		n, err := parseSize(s)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 || n > testFileMaxSize {
+			return nil, fmt.Errorf("test file size %q out of range", s)
+		}
+		f := newTestFile(s+testFileExt, n)
+		ret[f.name] = f
+	}
+	return ret, nil
+}
+
+func newTestFile(name string, size int64) *testFile {
+	sum := sha256.Sum256([]byte(name))
+	return &testFile{
+		name: name,
+		size: size,
+		key:  sum[:16],
+		// same content, same tag: any server of a multi server setup can resume a download
+		etag: `"` + hex.EncodeToString(sum[16:24]) + "-" + strconv.FormatInt(size, 16) + `"`,
+	}
+}
+
+// hashTestFiles computes the checksums of files, smallest first. Hashing large files takes
+// a while, so ListenAndServe runs it in the background and checksums are served once ready.
+func hashTestFiles(ctx context.Context, files map[string]*testFile) {
+	list := slices.SortedFunc(maps.Values(files), func(a, b *testFile) int {
+		return cmp.Compare(a.size, b.size)
+	})
+	for _, f := range list {
+		if ctx.Err() != nil {
+			return
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, f.open()); err != nil {
+			slog.Error("hashing test file", slog.String("name", f.name), slog.Any("error", err))
+			continue
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		f.checksum.Store(&sum)
+	}
+}
+
+func (f *testFile) open() *testFileReader {
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		panic(fmt.Errorf("failed to create test file cipher: %s", err))
+	}
+	return &testFileReader{block: block, size: f.size}
+}
+
+// testFileReader is an io.ReadSeeker over the content of a testFile, as needed by http.ServeContent
+type testFileReader struct {
+	block  cipher.Block
+	size   int64
+	offset int64
+	// nil after seeking, recreated at the new offset by the next read
+	stream cipher.Stream
+}
+
+func (r *testFileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - r.offset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	if r.stream == nil {
+		var iv [aes.BlockSize]byte
+		binary.BigEndian.PutUint64(iv[8:], uint64(r.offset/aes.BlockSize))
+		r.stream = cipher.NewCTR(r.block, iv[:])
+		// skip to the offset within the block
+		var skip [aes.BlockSize]byte
+		s := skip[:r.offset%aes.BlockSize]
+		r.stream.XORKeyStream(s, s)
+	}
+	clear(p)
+	r.stream.XORKeyStream(p, p)
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (r *testFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if offset != r.offset {
+		r.offset = offset
+		r.stream = nil
+	}
+	return offset, nil
+}
+
+// testFileHandler serves /files/<size>.bin with Range and conditional request support,
+// /files/<size>.bin.sha256 and /files/SHA256SUMS with checksums in the format of sha256sum
+func testFileHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if name == testFileChecksums {
+		names := slices.Sorted(maps.Keys(testFiles))
+		var b strings.Builder
+		for _, k := range names {
+			sum := testFiles[k].checksum.Load()
+			if sum == nil {
+				checksumsPending(w)
+				return
+			}
+			fmt.Fprintf(&b, "%s  %s\n", *sum, k)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, b.String())
+		return
+	}
+	if f, ok := testFiles[strings.TrimSuffix(name, ".sha256")]; ok && strings.HasSuffix(name, ".sha256") {
+		sum := f.checksum.Load()
+		if sum == nil {
+			checksumsPending(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "%s  %s\n", *sum, f.name)
+		return
+	}
+
+	f, ok := testFiles[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// a solved challenge has to cover the requested part of the file
+	want := requestedLength(r, f)
+	pm, ok := requirePoW(w, r, want)
+	if !ok {
+		return
+	}
+	defer pm.finish()
+	m := quotas.meter(remoteIP(r), session.Download)
+	defer m.finish()
+	if m.allow(1) == 0 {
+		quotaExceeded(w)
+		return
+	}
+	w.Header().Set("ETag", f.etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// the content never changes, there's no modification time to report
+	w = powWriter{ResponseWriter: quotaWriter{ResponseWriter: w, m: m}, m: pm}
+	http.ServeContent(w, r, f.name, time.Time{}, f.open())
+}
+
+// requestedLength returns how many bytes of f the request will be served, the whole file
+// unless it asks for valid ranges of it that http.ServeContent will honor
+func requestedLength(r *http.Request, f *testFile) int64 {
+	if r.Method == http.MethodHead {
+		return 0
+	}
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok {
+		return f.size
+	}
+	if v := r.Header.Get("If-Range"); v != "" && v != f.etag {
+		return f.size
+	}
+	var n int64
+	for _, rng := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(rng), "-")
+		if !ok {
+			return f.size
+		}
+		if first == "" {
+			// the last bytes of the file
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return f.size
+			}
+			n += min(suffix, f.size)
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 || start >= f.size {
+			return f.size
+		}
+		end := f.size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return f.size
+			}
+		}
+		n += min(end, f.size-1) - start + 1
+	}
+	return min(n, f.size)
+}
+
+// checksumsPending answers requests for checksums that are still being computed
+func checksumsPending(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "10")
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
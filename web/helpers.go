@@ -4,6 +4,10 @@ import (
 	"crypto/rand"
 	"fmt"
 	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -27,6 +31,34 @@ func getRandomData(length int) []byte {
 	return data
 }
 
+var sizeRegex = regexp.MustCompile(`^(\d+)(B|KB|MB|GB|TB)?$`)
+
+// parseSize parses a size in bytes, optionally suffixed with a binary unit, like 256KB or 1GB
+func parseSize(s string) (int64, error) {
+	m := sizeRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected something like 100MB", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	shift := map[string]int{"": 0, "B": 0, "KB": 10, "MB": 20, "GB": 30, "TB": 40}[m[2]]
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q too large", s)
+	}
+	return n << shift, nil
+}
+
+// remoteIP returns the client's IP address, as set by the realIP middleware
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func getIPInfoURL(address string) string {
 	apiKey := config.LoadedConfig().IPInfoAPIKey
 
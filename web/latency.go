@@ -0,0 +1,105 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/librespeed/speedtest/session"
+)
+
+type sessionResponse struct {
+	Session string `json:"session"`
+	Expires int64  `json:"expires"`
+}
+
+type latencyPingResponse struct {
+	Seq        uint64        `json:"seq"`
+	Phase      session.Phase `json:"phase"`
+	ServerTime int64         `json:"serverTime"`
+}
+
+// createSession starts a test session. Passing ?session=<id> to garbage and empty
+// marks their transfers as running, so latency probes can be told apart by load,
+// and records them as streams of the session's throughput report.
+func createSession(w http.ResponseWriter, r *http.Request) {
+	s, err := session.New(remoteIP(r))
+	if errors.Is(err, session.ErrTooManyForIP) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	render.JSON(w, r, sessionResponse{
+		Session: s.ID,
+		Expires: s.Expires().Unix(),
+	})
+}
+
+// sessionReport returns per stream and aggregate throughput of the transfers of a session
+func sessionReport(w http.ResponseWriter, r *http.Request) {
+	s, ok := requestSession(r)
+	if !ok || s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, s.Report())
+}
+
+// requestSession returns the session named by the session query parameter. ok is false
+// if the parameter is set but the session doesn't exist or belongs to another client.
+func requestSession(r *http.Request) (s *session.Session, ok bool) {
+	// query string only, FormValue would try to parse upload bodies
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		return nil, true
+	}
+	s = session.Get(id)
+	if s == nil || s.IP != remoteIP(r) {
+		return nil, false
+	}
+	return s, true
+}
+
+// latencyPing is the latency probe of a session. Each response carries a sequence number,
+// and the client reports the probe's round trip time on the next one with ?seq=<n>&rtt=<ms>.
+// Samples are classified by the transfers running when the probe arrived.
+func latencyPing(w http.ResponseWriter, r *http.Request) {
+	s, ok := requestSession(r)
+	if !ok || s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if v := r.FormValue("seq"); v != "" {
+		seq, err := strconv.ParseUint(v, 10, 64)
+		rtt, rerr := strconv.ParseFloat(r.FormValue("rtt"), 64)
+		if err != nil || rerr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.AddSample(seq, time.Duration(rtt*float64(time.Millisecond)))
+	}
+
+	seq, phase := s.Probe()
+	render.JSON(w, r, latencyPingResponse{
+		Seq:        seq,
+		Phase:      phase,
+		ServerTime: time.Now().UnixMilli(),
+	})
+}
+
+// latencyResult returns idle and loaded latency of a session, and its bufferbloat grade
+func latencyResult(w http.ResponseWriter, r *http.Request) {
+	s, ok := requestSession(r)
+	if !ok || s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, s.Latency())
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -10,7 +11,11 @@ import (
 
 	"github.com/coreos/go-systemd/v22/activation"
 	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/tcpconn"
 	"github.com/pires/go-proxyproto"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
 )
 
 func startListener(ctx context.Context, conf *config.Config, r http.Handler) error {
@@ -46,6 +51,14 @@ func startListener(ctx context.Context, conf *config.Config, r http.Handler) err
 		return fmt.Errorf("asked to listen on %d sockets via systemd activation.  Sorry we currently only support listening on 1 socket", len(listeners))
 	}
 
+	if err := tcpconn.ConfigureListener(listener, tcpconn.ListenerOptions{
+		CongestionControl: conf.TCPCongestionControl,
+		SendBuffer:        conf.TCPSendBuffer,
+		ReceiveBuffer:     conf.TCPRecvBuffer,
+	}); err != nil {
+		return fmt.Errorf("failed to configure listener: %w", err)
+	}
+
 	if conf.EnableProxyprotocol {
 		slog.Info("use proxy protocol listener")
 		pl := &proxyproto.Listener{
@@ -59,8 +72,37 @@ func startListener(ctx context.Context, conf *config.Config, r http.Handler) err
 		defer pl.Close()
 	}
 
+	h3, r, err := newHTTP3Server(conf, r)
+	if err != nil {
+		return err
+	}
+
+	// WebTransport runs on top of the HTTP/3 server and takes over serving it
+	h3ListenFn := func() error {
+		return h3.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
+	}
+	h3CloseFn := func() error {
+		return h3.Close()
+	}
+	if conf.EnableWebTransport {
+		webtransport.ConfigureHTTP3Server(h3)
+		wtServer.H3 = h3
+		h3ListenFn = func() error {
+			cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+			if err != nil {
+				return err
+			}
+			// unlike http3.Server, webtransport.Server doesn't set up ALPN by itself
+			h3.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+			return wtServer.ListenAndServe()
+		}
+		h3CloseFn = wtServer.Close
+	}
+
 	srv := &http.Server{
 		Handler: r,
+		// handlers read TCP_INFO from the accepted connection
+		ConnContext: tcpconn.ConnContext,
 	}
 	srv.Protocols = new(http.Protocols)
 	srv.Protocols.SetHTTP1(true)
@@ -93,10 +135,61 @@ func startListener(ctx context.Context, conf *config.Config, r http.Handler) err
 			panic(fmt.Errorf("failed to listen: %w", err))
 		}
 	}()
+	if h3 != nil {
+		slog.Info("Use HTTP3 connection.", "address", h3.Addr)
+		go func() {
+			err := h3ListenFn()
+			slog.Info("http3 server closed")
+			if err != nil && err != http.ErrServerClosed && !errors.Is(err, quic.ErrServerClosed) && !errors.Is(err, context.Canceled) {
+				panic(fmt.Errorf("failed to listen on QUIC: %w", err))
+			}
+		}()
+	}
 	<-ctx.Done()
 	slog.Info("http server shutting down")
+	if h3 != nil {
+		if err := h3CloseFn(); err != nil {
+			slog.Error("closing http3 server", slog.Any("error", err))
+		}
+	}
 	err = srv.Shutdown(ctx)
 	slog.Info("http server shutdown finished")
 
 	return err
 }
+
+// newHTTP3Server returns the HTTP/3 server serving r if enable_http3 is set, or nil, and the
+// handler for the TCP server, which advertises the HTTP/3 one
+func newHTTP3Server(conf *config.Config, r http.Handler) (*http3.Server, http.Handler, error) {
+	if !conf.EnableHTTP3 {
+		if conf.EnableWebTransport {
+			return nil, nil, errors.New("enable_webtransport requires enable_http3")
+		}
+		return nil, r, nil
+	}
+	if !conf.EnableTLS {
+		return nil, nil, errors.New("enable_http3 requires enable_tls")
+	}
+	port := conf.HTTP3Port
+	if port == "" {
+		port = conf.Port
+	}
+	if port == "" {
+		return nil, nil, errors.New("http3_port must be set when using systemd socket activation")
+	}
+	h3 := &http3.Server{
+		Addr:    net.JoinHostPort(conf.BindAddress, port),
+		Handler: r,
+	}
+	return h3, altSvcHandler(h3, r), nil
+}
+
+// altSvcHandler advertises the HTTP/3 listener to TCP clients through the Alt-Svc header
+func altSvcHandler(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
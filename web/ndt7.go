@@ -0,0 +1,285 @@
+package web
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/oklog/ulid/v2"
+
+	"github.com/librespeed/speedtest/session"
+	"github.com/librespeed/speedtest/tcpconn"
+)
+
+// constants from the NDT7 specification, https://github.com/m-lab/ndt-server/blob/main/spec/ndt7-protocol.md
+const (
+	ndt7Subprotocol      = "net.measurementlab.ndt.v7"
+	ndt7Runtime          = 10 * time.Second
+	ndt7MinMessageSize   = 1 << 13
+	ndt7MaxMessageSize   = 1 << 24
+	ndt7MeasureInterval  = 250 * time.Millisecond
+	ndt7ScalingFraction  = 16
+	ndt7CloseGracePeriod = time.Second
+	ndt7WriteTimeout     = 7 * time.Second
+)
+
+var ndt7Upgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	Subprotocols:    []string{ndt7Subprotocol},
+	// CORS is open for every other endpoint as well
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// ndt7Measurement is the JSON text message the server sends during a test
+type ndt7Measurement struct {
+	AppInfo        ndt7AppInfo         `json:"AppInfo"`
+	ConnectionInfo *ndt7ConnectionInfo `json:"ConnectionInfo,omitempty"`
+	Origin         string              `json:"Origin"`
+	Test           string              `json:"Test"`
+	TCPInfo        *ndt7TCPInfo        `json:"TCPInfo,omitempty"`
+}
+
+type ndt7AppInfo struct {
+	// microseconds since the start of the test
+	ElapsedTime int64 `json:"ElapsedTime"`
+	NumBytes    int64 `json:"NumBytes"`
+}
+
+type ndt7ConnectionInfo struct {
+	Client string `json:"Client"`
+	Server string `json:"Server"`
+	UUID   string `json:"UUID"`
+}
+
+type ndt7TCPInfo struct {
+	tcpconn.Info
+	ElapsedTime int64 `json:"ElapsedTime"`
+}
+
+// ndt7Test holds the state shared by the download and upload subtests
+type ndt7Test struct {
+	name  string
+	conn  *websocket.Conn
+	start time.Time
+	// bytes sent for downloads, received for uploads
+	bytes atomic.Int64
+	// ConnectionInfo is only sent with the first measurement
+	connInfo *ndt7ConnectionInfo
+}
+
+func newNDT7Test(w http.ResponseWriter, r *http.Request, name string) *ndt7Test {
+	if !slices.Contains(websocket.Subprotocols(r), ndt7Subprotocol) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	conn, err := ndt7Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("upgrading NDT7 connection", slog.Any("error", err))
+		return nil
+	}
+	return &ndt7Test{
+		name:  name,
+		conn:  conn,
+		start: time.Now(),
+		connInfo: &ndt7ConnectionInfo{
+			Client: conn.RemoteAddr().String(),
+			Server: conn.LocalAddr().String(),
+			UUID:   ulid.Make().String(),
+		},
+	}
+}
+
+func (t *ndt7Test) measurement() ndt7Measurement {
+	now := time.Now()
+	m := ndt7Measurement{
+		AppInfo: ndt7AppInfo{
+			ElapsedTime: now.Sub(t.start).Microseconds(),
+			NumBytes:    t.bytes.Load(),
+		},
+		ConnectionInfo: t.connInfo,
+		Origin:         "server",
+		Test:           t.name,
+	}
+	t.connInfo = nil
+	if info, err := tcpconn.ReadInfo(t.conn.NetConn()); err == nil {
+		m.TCPInfo = &ndt7TCPInfo{Info: *info, ElapsedTime: m.AppInfo.ElapsedTime}
+	} else if !errors.Is(err, tcpconn.ErrUnsupported) {
+		slog.Debug("reading TCP_INFO", slog.Any("error", err))
+	}
+	return m
+}
+
+func (t *ndt7Test) writeMeasurement() error {
+	_ = t.conn.SetWriteDeadline(time.Now().Add(ndt7WriteTimeout))
+	return t.conn.WriteJSON(t.measurement())
+}
+
+// close ends the test with a normal closure and waits briefly for the client to close as well
+func (t *ndt7Test) close(clientDone <-chan struct{}) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(ndt7CloseGracePeriod))
+	select {
+	case <-clientDone:
+	case <-time.After(ndt7CloseGracePeriod):
+	}
+	_ = t.conn.Close()
+}
+
+// ndt7Download implements the NDT7 download subtest: binary messages of random data,
+// growing from 8 KiB as the transfer progresses, interleaved with measurements
+func ndt7Download(w http.ResponseWriter, r *http.Request) {
+	pm, ok := requirePoW(w, r, ndt7MinMessageSize)
+	if !ok {
+		return
+	}
+	defer pm.finish()
+	m := quotas.meter(remoteIP(r), session.Download)
+	defer m.finish()
+	if m.allow(ndt7MinMessageSize) == 0 {
+		quotaExceeded(w)
+		return
+	}
+	t := newNDT7Test(w, r, "download")
+	if t == nil {
+		return
+	}
+
+	// the client may send its own measurements, which are read and ignored
+	clientDone := make(chan struct{})
+	t.conn.SetReadLimit(ndt7MaxMessageSize)
+	go func() {
+		defer close(clientDone)
+		for {
+			_, rd, err := t.conn.NextReader()
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, rd)
+		}
+	}()
+	defer t.close(clientDone)
+
+	// messages are sliced from randomData, which caps them well below ndt7MaxMessageSize
+	maxSize := min(ndt7MaxMessageSize, len(randomData))
+	size := min(ndt7MinMessageSize, maxSize)
+	deadline := t.start.Add(ndt7Runtime)
+	nextMeasurement := t.start
+	for {
+		now := time.Now()
+		if now.After(deadline) {
+			break
+		}
+		select {
+		case <-clientDone:
+			return
+		default:
+		}
+		if !now.Before(nextMeasurement) {
+			if err := t.writeMeasurement(); err != nil {
+				slog.Debug("writing NDT7 measurement", slog.Any("error", err))
+				return
+			}
+			nextMeasurement = now.Add(ndt7MeasureInterval)
+		}
+
+		if pm.allow(m.allow(int64(size))) < int64(size) {
+			slog.Debug("NDT7 download stopped by quota or proof-of-work budget")
+			break
+		}
+		_ = t.conn.SetWriteDeadline(now.Add(ndt7WriteTimeout))
+		if err := t.conn.WriteMessage(websocket.BinaryMessage, randomData[:size]); err != nil {
+			slog.Debug("writing NDT7 download message", slog.Any("error", err))
+			return
+		}
+		m.add(int64(size))
+		pm.add(int64(size))
+		sent := t.bytes.Add(int64(size))
+		if size < maxSize && int64(size) <= sent/ndt7ScalingFraction {
+			size = min(size*2, maxSize)
+		}
+	}
+	if err := t.writeMeasurement(); err != nil {
+		slog.Debug("writing NDT7 measurement", slog.Any("error", err))
+	}
+}
+
+// ndt7Upload implements the NDT7 upload subtest: the client sends binary messages
+// for up to 10 seconds, while the server sends measurements of what it received
+func ndt7Upload(w http.ResponseWriter, r *http.Request) {
+	m := quotas.meter(remoteIP(r), session.Upload)
+	if m.allow(ndt7MinMessageSize) == 0 {
+		m.finish()
+		quotaExceeded(w)
+		return
+	}
+	t := newNDT7Test(w, r, "upload")
+	if t == nil {
+		m.finish()
+		return
+	}
+
+	clientDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		ticker := time.NewTicker(ndt7MeasureInterval)
+		defer ticker.Stop()
+		deadline := time.NewTimer(time.Until(t.start.Add(ndt7Runtime)))
+		defer deadline.Stop()
+		for {
+			if err := t.writeMeasurement(); err != nil {
+				slog.Debug("writing NDT7 measurement", slog.Any("error", err))
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-deadline.C:
+				_ = t.writeMeasurement()
+				return
+			case <-clientDone:
+				return
+			}
+		}
+	}()
+
+	t.conn.SetReadLimit(ndt7MaxMessageSize)
+	_ = t.conn.SetReadDeadline(t.start.Add(ndt7Runtime + ndt7CloseGracePeriod))
+	// the meter is only used by the reader, which may outlive the handler by the grace period
+	go func() {
+		defer close(clientDone)
+		defer m.finish()
+		buf := make([]byte, 32*1024)
+		for {
+			_, rd, err := t.conn.NextReader()
+			if err != nil {
+				var ne net.Error
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !(errors.As(err, &ne) && ne.Timeout()) {
+					slog.Debug("reading NDT7 upload message", slog.Any("error", err))
+				}
+				return
+			}
+			qr := quotaReader{r: rd, m: m}
+			for {
+				n, err := qr.Read(buf)
+				t.bytes.Add(int64(n))
+				if errors.Is(err, errQuotaExceeded) {
+					slog.Debug("NDT7 upload stopped by quota")
+					return
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+	}()
+
+	<-writerDone
+	t.close(clientDone)
+}
@@ -0,0 +1,60 @@
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// payloadFunc returns the next chunk of data to send to the client
+type payloadFunc func() []byte
+
+func staticPayload() []byte {
+	return randomData
+}
+
+var keystreamBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, len(randomData))
+		return &b
+	},
+}
+
+// keystream generates an AES-CTR stream keyed per request, so the payload never repeats
+// between chunks or requests and can't be deduplicated by WAN optimizers.
+// AES-CTR is used over ChaCha8 since it runs several times faster on CPUs with AES instructions.
+type keystream struct {
+	stream cipher.Stream
+	buf    *[]byte
+}
+
+func newKeystream() *keystream {
+	// 16 bytes of AES-128 key followed by the IV
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic(fmt.Errorf("failed to seed keystream: %s", err))
+	}
+	block, err := aes.NewCipher(seed[:16])
+	if err != nil {
+		panic(fmt.Errorf("failed to create keystream cipher: %s", err))
+	}
+	return &keystream{
+		stream: cipher.NewCTR(block, seed[16:]),
+		buf:    keystreamBuffers.Get().(*[]byte),
+	}
+}
+
+func (k *keystream) next() []byte {
+	buf := *k.buf
+	// XORing the previous chunk with fresh keystream is as good as encrypting zeroes
+	k.stream.XORKeyStream(buf, buf)
+	return buf
+}
+
+// release returns the buffer to the pool, the keystream must not be used afterwards
+func (k *keystream) release() {
+	keystreamBuffers.Put(k.buf)
+	k.buf = nil
+}
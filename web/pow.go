@@ -0,0 +1,166 @@
+package web
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/librespeed/speedtest/pow"
+)
+
+var errPoWRequired = errors.New("proof-of-work required")
+
+// clients that haven't downloaded anything for this long are forgotten, and get a fresh budget
+const powBudgetIdle = time.Hour
+
+// each client may download this much before it has to solve a proof-of-work challenge,
+// if pow_difficulty is set
+var powThreshold int64
+
+// powBudgets counts down the bytes each client may still download before it has to
+// solve another challenge, across all download endpoints. Bytes are taken from the budget
+// when they are reserved by a download, not when they have been sent.
+var powBudgets = &powBudgetTracker{clients: make(map[string]*powBudget)}
+
+type powBudgetTracker struct {
+	mu        sync.Mutex
+	clients   map[string]*powBudget
+	lastSweep time.Time
+}
+
+type powBudget struct {
+	left     int64
+	lastSeen time.Time
+}
+
+// client returns the budget of ip, t.mu must be held
+func (t *powBudgetTracker) client(ip string, now time.Time) *powBudget {
+	if now.Sub(t.lastSweep) > time.Minute {
+		for k, v := range t.clients {
+			if now.Sub(v.lastSeen) > powBudgetIdle {
+				delete(t.clients, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	b, ok := t.clients[ip]
+	if !ok {
+		b = &powBudget{left: powThreshold}
+		t.clients[ip] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// powChallenge issues a proof-of-work challenge for the client
+func powChallenge(w http.ResponseWriter, r *http.Request) {
+	if !pow.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, pow.Issue(remoteIP(r)))
+}
+
+// powMeter reserves the bytes of a download from the client's budget before they are sent,
+// so that concurrent downloads can't spend the same budget. It isn't safe for concurrent use.
+// A nil powMeter, as returned while proof-of-work is disabled, allows everything.
+type powMeter struct {
+	ip       string
+	reserved int64
+	used     int64
+}
+
+// requirePoW starts a download of at least want bytes and reserves them, the caller must call
+// finish on the returned meter once the download is done. A challenge solution passed with
+// ?pow=<challenge>&powSolution=<solution> adds pow_threshold, or want if that is larger, to
+// the client's budget. It answers 403 if the solution isn't valid, or if the budget doesn't
+// cover want bytes.
+func requirePoW(w http.ResponseWriter, r *http.Request, want int64) (*powMeter, bool) {
+	if !pow.Enabled() {
+		return nil, true
+	}
+	ip := remoteIP(r)
+	challenge := r.FormValue("pow")
+	if challenge != "" {
+		if err := pow.Verify(challenge, r.FormValue("powSolution"), ip); err != nil {
+			slog.Debug("Proof-of-work rejected", slog.String("ip", ip), slog.Any("error", err))
+			w.WriteHeader(http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	powBudgets.mu.Lock()
+	defer powBudgets.mu.Unlock()
+	b := powBudgets.client(ip, time.Now())
+	if challenge != "" {
+		b.left += max(powThreshold, want)
+	}
+	if b.left < want {
+		slog.Debug("Proof-of-work required", slog.String("ip", ip), slog.Int64("size", want))
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	b.left -= want
+	return &powMeter{ip: ip, reserved: want}, true
+}
+
+// allow returns how many of the next n bytes may be sent, reserving what it needs from
+// the budget, 0 once the budget is used up
+func (m *powMeter) allow(n int64) int64 {
+	if m == nil {
+		return n
+	}
+	if rest := m.reserved - m.used; rest < n {
+		powBudgets.mu.Lock()
+		b := powBudgets.client(m.ip, time.Now())
+		more := max(min(n-rest, b.left), 0)
+		b.left -= more
+		m.reserved += more
+		powBudgets.mu.Unlock()
+	}
+	return min(n, m.reserved-m.used)
+}
+
+// add counts n sent bytes, which allow must have allowed
+func (m *powMeter) add(n int64) {
+	if m == nil {
+		return
+	}
+	m.used += n
+}
+
+// finish gives the reserved bytes that weren't sent back to the budget
+func (m *powMeter) finish() {
+	if m == nil || m.reserved <= m.used {
+		return
+	}
+	powBudgets.mu.Lock()
+	defer powBudgets.mu.Unlock()
+	powBudgets.client(m.ip, time.Now()).left += m.reserved - m.used
+	m.reserved = m.used
+}
+
+// powWriter writes through a powMeter, failing with errPoWRequired once its budget is used up
+type powWriter struct {
+	http.ResponseWriter
+	m *powMeter
+}
+
+func (w powWriter) Write(p []byte) (int, error) {
+	n := w.m.allow(int64(len(p)))
+	written, err := w.ResponseWriter.Write(p[:n])
+	w.m.add(int64(written))
+	if err == nil && written < len(p) {
+		err = errPoWRequired
+	}
+	return written, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w powWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,345 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database/schema"
+	"github.com/librespeed/speedtest/session"
+)
+
+// quotaTracker enforces daily limits on the traffic of downloads and uploads, per client IP
+// and for the whole server. Days start at midnight UTC. Like rate limits, per client quotas
+// are shared by the addresses of a subnet, otherwise IPv6 clients could use a new address
+// for each test.
+//
+// Transfers reserve their bytes before sending or receiving them, so concurrent tests can't
+// overshoot the limits: up front if their size is known, otherwise in increments through a
+// quotaMeter. Counters are loaded from the database on start and written back periodically.
+type quotaTracker struct {
+	// by session.Direction, 0 for no limit
+	perIP  [2]int64
+	global [2]int64
+	store  schema.DataAccess
+	// prefix lengths clients are grouped by
+	ipv4Bits int
+	ipv6Bits int
+
+	mu      sync.Mutex
+	day     time.Time
+	clients map[string]*quotaCounter
+	total   quotaCounter
+	// traffic not written to the database yet, by day and client
+	pending map[quotaKey]*schema.QuotaUsage
+}
+
+type quotaCounter struct {
+	used     [2]int64
+	reserved [2]int64
+}
+
+type quotaKey struct {
+	day time.Time
+	ip  string
+}
+
+// transfers of unknown length reserve this much quota at a time
+const quotaIncrement = 4 << 20
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// newQuotaTracker returns nil if no quota is configured
+func newQuotaTracker(conf *config.Config, store schema.DataAccess) (*quotaTracker, error) {
+	q := &quotaTracker{
+		store:    store,
+		ipv4Bits: min(max(conf.RateLimitIPv4Prefix, 0), 32),
+		ipv6Bits: min(max(conf.RateLimitIPv6Prefix, 0), 128),
+		clients:  make(map[string]*quotaCounter),
+		pending:  make(map[quotaKey]*schema.QuotaUsage),
+	}
+	for _, opt := range []struct {
+		name  string
+		value string
+		limit *int64
+	}{
+		{"quota_download_per_ip", conf.QuotaDownloadPerIP, &q.perIP[session.Download]},
+		{"quota_upload_per_ip", conf.QuotaUploadPerIP, &q.perIP[session.Upload]},
+		{"quota_download", conf.QuotaDownload, &q.global[session.Download]},
+		{"quota_upload", conf.QuotaUpload, &q.global[session.Upload]},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		n, err := parseSize(opt.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", opt.name, err)
+		}
+		*opt.limit = n
+	}
+	if q.perIP == [2]int64{} && q.global == [2]int64{} {
+		return nil, nil
+	}
+
+	q.day = quotaDay(time.Now())
+	usage, err := store.FetchQuotaUsage(q.day)
+	if err != nil {
+		return nil, fmt.Errorf("loading quota usage: %w", err)
+	}
+	for _, u := range usage {
+		c := &q.total
+		if u.IPAddress != "" {
+			c = q.client(q.key(u.IPAddress))
+		}
+		c.used[session.Download] += u.Egress
+		c.used[session.Upload] += u.Ingress
+	}
+	return q, nil
+}
+
+func quotaDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// key returns the subnet of ip its quota is kept for
+func (q *quotaTracker) key(ip string) string {
+	return subnetKey(ip, q.ipv4Bits, q.ipv6Bits)
+}
+
+// client returns the counter of the client key, q.mu must be held
+func (q *quotaTracker) client(key string) *quotaCounter {
+	c, ok := q.clients[key]
+	if !ok {
+		c = &quotaCounter{}
+		q.clients[key] = c
+	}
+	return c
+}
+
+// rollover resets the counters at midnight, q.mu must be held.
+// Transfers still running keep their reservations.
+func (q *quotaTracker) rollover(now time.Time) {
+	day := quotaDay(now)
+	if !day.After(q.day) {
+		return
+	}
+	q.day = day
+	q.total.used = [2]int64{}
+	for ip, c := range q.clients {
+		if c.reserved == [2]int64{} {
+			delete(q.clients, ip)
+		} else {
+			c.used = [2]int64{}
+		}
+	}
+}
+
+// reserve grants up to want bytes of traffic in direction d to the client at ip, the
+// caller must pass the granted amount to finish once the transfer is done.
+// A nil quotaTracker grants everything.
+func (q *quotaTracker) reserve(ip string, d session.Direction, want int64) int64 {
+	if q == nil {
+		return want
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+
+	if !q.limited(d) {
+		return want
+	}
+	c := q.client(q.key(ip))
+	granted := want
+	if limit := q.perIP[d]; limit > 0 {
+		granted = min(granted, limit-c.used[d]-c.reserved[d])
+	}
+	if limit := q.global[d]; limit > 0 {
+		granted = min(granted, limit-q.total.used[d]-q.total.reserved[d])
+	}
+	granted = max(granted, 0)
+	c.reserved[d] += granted
+	q.total.reserved[d] += granted
+	return granted
+}
+
+// limited reports whether traffic in direction d has a quota, otherwise it is only counted
+func (q *quotaTracker) limited(d session.Direction) bool {
+	return q.perIP[d] > 0 || q.global[d] > 0
+}
+
+// finish releases a reservation and records the bytes actually transferred
+func (q *quotaTracker) finish(ip string, d session.Direction, granted, n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+
+	key := q.key(ip)
+	c := q.client(key)
+	if q.limited(d) {
+		c.reserved[d] -= granted
+		q.total.reserved[d] -= granted
+	}
+	c.used[d] += n
+	q.total.used[d] += n
+
+	for _, addr := range []string{key, ""} {
+		k := quotaKey{day: q.day, ip: addr}
+		p, ok := q.pending[k]
+		if !ok {
+			p = &schema.QuotaUsage{Day: q.day, IPAddress: addr}
+			q.pending[k] = p
+		}
+		if d == session.Download {
+			p.Egress += n
+		} else {
+			p.Ingress += n
+		}
+	}
+}
+
+// flush writes the pending counters to the database, they are kept for the next
+// attempt if that fails
+func (q *quotaTracker) flush() {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = make(map[quotaKey]*schema.QuotaUsage)
+	q.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	usage := make([]schema.QuotaUsage, 0, len(pending))
+	for _, p := range pending {
+		usage = append(usage, *p)
+	}
+	if err := q.store.AddQuotaUsage(usage); err != nil {
+		slog.Error("Error saving quota usage", slog.Any("error", err))
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for k, p := range pending {
+			if cur, ok := q.pending[k]; ok {
+				cur.Egress += p.Egress
+				cur.Ingress += p.Ingress
+			} else {
+				q.pending[k] = p
+			}
+		}
+	}
+}
+
+// run flushes the counters every interval until ctx is done
+func (q *quotaTracker) run(ctx context.Context, interval time.Duration) {
+	if q == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			q.flush()
+			return
+		case <-ticker.C:
+			q.flush()
+		}
+	}
+}
+
+// quotaExceeded answers 429, with Retry-After set to the start of the next day
+func quotaExceeded(w http.ResponseWriter) {
+	now := time.Now()
+	next := quotaDay(now).Add(24 * time.Hour)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(next.Sub(now).Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// quotaMeter reserves quota in increments as a transfer of unknown length goes on, so it
+// never holds much more than it has used. It isn't safe for concurrent use.
+type quotaMeter struct {
+	q       *quotaTracker
+	ip      string
+	d       session.Direction
+	granted int64
+	used    int64
+}
+
+// meter returns a quotaMeter for a transfer in direction d of the client at ip, the caller
+// must call its finish method once the transfer is done. The meter of a nil quotaTracker
+// allows everything.
+func (q *quotaTracker) meter(ip string, d session.Direction) *quotaMeter {
+	return &quotaMeter{q: q, ip: ip, d: d}
+}
+
+// allow returns how many of the next n bytes may be transferred, 0 once the quota is used up
+func (m *quotaMeter) allow(n int64) int64 {
+	if m.q == nil {
+		return n
+	}
+	if rest := m.granted - m.used; rest < n {
+		m.granted += m.q.reserve(m.ip, m.d, max(n-rest, quotaIncrement))
+	}
+	return min(n, m.granted-m.used)
+}
+
+// add counts n transferred bytes, which allow must have allowed
+func (m *quotaMeter) add(n int64) {
+	m.used += n
+}
+
+// finish releases the unused part of the reservation and records the traffic
+func (m *quotaMeter) finish() {
+	m.q.finish(m.ip, m.d, m.granted, m.used)
+}
+
+// quotaWriter writes through a quotaMeter, failing with errQuotaExceeded once its quota is used up
+type quotaWriter struct {
+	http.ResponseWriter
+	m *quotaMeter
+}
+
+func (w quotaWriter) Write(p []byte) (int, error) {
+	n := w.m.allow(int64(len(p)))
+	written, err := w.ResponseWriter.Write(p[:n])
+	w.m.add(int64(written))
+	if err == nil && written < len(p) {
+		err = errQuotaExceeded
+	}
+	return written, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w quotaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// quotaReader reads through a quotaMeter, failing with errQuotaExceeded once its quota is used up
+type quotaReader struct {
+	r io.Reader
+	m *quotaMeter
+}
+
+func (r quotaReader) Read(p []byte) (int, error) {
+	n := r.m.allow(int64(len(p)))
+	if n == 0 && len(p) > 0 {
+		// the body may end right at the quota
+		var b [1]byte
+		if read, err := r.r.Read(b[:]); read == 0 && err != nil {
+			return 0, err
+		}
+		return 0, errQuotaExceeded
+	}
+	read, err := r.r.Read(p[:n])
+	r.m.add(int64(read))
+	return read, err
+}
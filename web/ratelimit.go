@@ -0,0 +1,155 @@
+package web
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/librespeed/speedtest/config"
+)
+
+// clients without requests in flight are forgotten after being idle for this long
+const rateLimitIdle = time.Minute
+
+// rateLimiter limits the request rate and the number of concurrent streams of each client
+// on the test endpoints. Clients are grouped by subnet, so a single host can't get around
+// the limits by using many IPv6 addresses.
+type rateLimiter struct {
+	limit      rate.Limit
+	burst      int
+	maxStreams int
+	ipv4Bits   int
+	ipv6Bits   int
+
+	mu        sync.Mutex
+	clients   map[string]*rateLimitClient
+	lastSweep time.Time
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	streams  int
+	lastSeen time.Time
+}
+
+// newRateLimiter returns nil if neither a request rate nor a stream limit is configured
+func newRateLimiter(conf *config.Config) *rateLimiter {
+	if conf.RateLimitRequests <= 0 && conf.RateLimitStreams <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		limit:      rate.Inf,
+		burst:      max(conf.RateLimitBurst, 1),
+		maxStreams: conf.RateLimitStreams,
+		ipv4Bits:   min(max(conf.RateLimitIPv4Prefix, 0), 32),
+		ipv6Bits:   min(max(conf.RateLimitIPv6Prefix, 0), 128),
+		clients:    make(map[string]*rateLimitClient),
+		lastSweep:  time.Now(),
+	}
+	if conf.RateLimitRequests > 0 {
+		l.limit = rate.Limit(conf.RateLimitRequests)
+	}
+	return l
+}
+
+// Handler answers 429 with a Retry-After header to clients over their limits.
+// A nil rateLimiter lets all requests through.
+func (l *rateLimiter) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.key(remoteIP(r))
+		retry, ok := l.acquire(key, time.Now())
+		if !ok {
+			slog.Debug("Rate limited", slog.String("client", key), slog.Duration("retry", retry))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// key returns the subnet of ip clients are grouped by
+func (l *rateLimiter) key(ip string) string {
+	return subnetKey(ip, l.ipv4Bits, l.ipv6Bits)
+}
+
+// subnetKey returns the subnet of ip with the prefix length for its address family, or the
+// address itself if the prefix covers all of it. Quotas group clients like the rate limiter.
+func subnetKey(ip string, ipv4Bits, ipv6Bits int) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := ipv6Bits
+	if addr.Is4() {
+		bits = ipv4Bits
+	}
+	if bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// acquire takes a token and a stream slot for the client, or returns how long it should
+// wait before trying again
+func (l *rateLimiter) acquire(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		l.sweep(now)
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &rateLimitClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	if l.maxStreams > 0 && c.streams >= l.maxStreams {
+		// there's no telling when a running test finishes
+		return time.Second, false
+	}
+	res := c.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+	c.streams++
+	return 0, true
+}
+
+func (l *rateLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.clients[key]; ok {
+		c.streams--
+		c.lastSeen = time.Now()
+	}
+}
+
+// sweep forgets idle clients whose token bucket has refilled
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, c := range l.clients {
+		if c.streams == 0 && now.Sub(c.lastSeen) > rateLimitIdle &&
+			c.limiter.TokensAt(now) >= float64(l.burst) {
+			delete(l.clients, k)
+		}
+	}
+	l.lastSweep = now
+}
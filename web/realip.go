@@ -0,0 +1,89 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the peers whose forwarding headers are believed
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies accepts addresses and CIDR prefixes
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+	ret := make(trustedProxies, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("trusted_proxies: %w", err)
+			}
+			ret = append(ret, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %w", err)
+		}
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
+
+func (t trustedProxies) contains(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP replaces the address in r.RemoteAddr with the client's, as told by X-Forwarded-For,
+// or by header if it is set, if the peer is a trusted proxy. Otherwise the headers are
+// ignored, as rate limits, quotas and test slots are keyed on the address.
+func (t trustedProxies) realIP(header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, port, err := net.SplitHostPort(r.RemoteAddr)
+			if err == nil && t.contains(host) {
+				if ip := t.forwardedFor(r, header); ip != "" {
+					r.RemoteAddr = net.JoinHostPort(ip, port)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the client address from the forwarding headers, or "" if they don't
+// name a valid one. In X-Forwarded-For, the rightmost address not of a trusted proxy is the
+// client's, anything left of it may have been sent by the client itself. A single address
+// header like X-Real-IP is only used if configured, as proxies that don't set it pass on
+// whatever the client sent.
+func (t trustedProxies) forwardedFor(r *http.Request, header string) string {
+	if header != "" {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(header))); err == nil {
+			return addr.Unmap().String()
+		}
+		return ""
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return ""
+		}
+		if s := addr.Unmap().String(); i == 0 || !t.contains(s) {
+			return s
+		}
+	}
+	return ""
+}
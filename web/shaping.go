@@ -0,0 +1,281 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/session"
+)
+
+const (
+	// upper limit for ?latency=
+	maxShapingLatency = 10 * time.Second
+	// smallest burst of the token bucket, in bytes
+	minShapingBurst = 4096
+	// emulated links without streams are forgotten after being idle for this long
+	shapedLinkIdle = 30 * time.Second
+)
+
+var rateRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kKMG]?)(?:bit|bps)?$`)
+
+// linkProfile describes an emulated link
+type linkProfile struct {
+	// bits per second, 0 for no limit
+	rate float64
+	// delay added before each response
+	latency time.Duration
+}
+
+// parseRate parses bit rates like "10M", "512k" or "1.5Gbit", decimal units
+func parseRate(s string) (float64, error) {
+	m := rateRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	switch m[2] {
+	case "k", "K":
+		v *= 1e3
+	case "M":
+		v *= 1e6
+	case "G":
+		v *= 1e9
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	return v, nil
+}
+
+// parseLatency accepts Go durations such as "30ms" as well as plain milliseconds
+func parseLatency(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		ms, merr := strconv.ParseFloat(s, 64)
+		if merr != nil {
+			return 0, err
+		}
+		d = time.Duration(ms * float64(time.Millisecond))
+	}
+	if d < 0 || d > maxShapingLatency {
+		return 0, fmt.Errorf("latency out of range: %s", s)
+	}
+	return d, nil
+}
+
+// parseLinkProfile parses profiles like "10M@30ms", either part may be left out
+func parseLinkProfile(s string) (linkProfile, error) {
+	var p linkProfile
+	rateStr, latencyStr, _ := strings.Cut(s, "@")
+	var err error
+	if rateStr != "" {
+		if p.rate, err = parseRate(rateStr); err != nil {
+			return p, err
+		}
+	}
+	if latencyStr != "" {
+		if p.latency, err = parseLatency(latencyStr); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// requestLinkProfile returns the link a request asks for with ?profile=, ?rate= and
+// ?latency=, the latter two override the profile
+func requestLinkProfile(r *http.Request, profiles map[string]string) (linkProfile, error) {
+	// query string only, FormValue would try to parse the upload body
+	query := r.URL.Query()
+	var p linkProfile
+	if name := query.Get("profile"); name != "" {
+		def, ok := profiles[name]
+		if !ok {
+			return p, fmt.Errorf("unknown profile: %s", name)
+		}
+		var err error
+		if p, err = parseLinkProfile(def); err != nil {
+			return p, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	if v := query.Get("rate"); v != "" {
+		r, err := parseRate(v)
+		if err != nil {
+			return p, err
+		}
+		p.rate = r
+	}
+	if v := query.Get("latency"); v != "" {
+		d, err := parseLatency(v)
+		if err != nil {
+			return p, err
+		}
+		p.latency = d
+	}
+	return p, nil
+}
+
+// shaping emulates a slower link for garbage and empty if enable_shaping is set: the
+// response is delayed by the requested latency, and the response body and request body are
+// throttled to the requested rate, which concurrent streams of the same test share
+func shaping(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := config.LoadedConfig()
+		if !conf.EnableShaping {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := requestLinkProfile(r, conf.ShapingProfiles)
+		if err != nil {
+			slog.Debug("Invalid shaping parameters", slog.Any("error", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if p.latency > 0 {
+			t := time.NewTimer(p.latency)
+			select {
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+		if p.rate > 0 {
+			// all streams of a test share the link, per direction
+			client := remoteIP(r)
+			if sess, ok := requestSession(r); ok && sess != nil {
+				client = "session " + sess.ID
+			}
+			down := linkKey{client: client, d: session.Download, rate: p.rate}
+			up := linkKey{client: client, d: session.Upload, rate: p.rate}
+			now := time.Now()
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: links.acquire(down, now)}
+			r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), limiter: links.acquire(up, now)}
+			defer links.release(down)
+			defer links.release(up)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shapedLinks are the emulated links in use, so that the streams of a multi stream test
+// together get the requested rate rather than each of them
+type shapedLinks struct {
+	mu        sync.Mutex
+	links     map[linkKey]*shapedLink
+	lastSweep time.Time
+}
+
+type linkKey struct {
+	// session ID if the request has one, otherwise the client IP
+	client string
+	d      session.Direction
+	rate   float64
+}
+
+type shapedLink struct {
+	limiter  *rate.Limiter
+	streams  int
+	lastUsed time.Time
+}
+
+var links = &shapedLinks{links: make(map[linkKey]*shapedLink)}
+
+// acquire returns the limiter of the link, the caller must call release once the stream is done
+func (s *shapedLinks) acquire(k linkKey, now time.Time) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Second {
+		for key, l := range s.links {
+			if l.streams == 0 && now.Sub(l.lastUsed) > shapedLinkIdle {
+				delete(s.links, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	l, ok := s.links[k]
+	if !ok {
+		bytesPerSec := k.rate / 8
+		// 10ms worth of data, so the rate is smooth at small time scales
+		burst := max(int(bytesPerSec/100), minShapingBurst)
+		l = &shapedLink{limiter: rate.NewLimiter(rate.Limit(bytesPerSec), burst)}
+		s.links[k] = l
+	}
+	l.streams++
+	l.lastUsed = now
+	return l.limiter
+}
+
+func (s *shapedLinks) release(k linkKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.links[k]; ok {
+		l.streams--
+		l.lastUsed = time.Now()
+	}
+}
+
+// throttledWriter limits the rate of writes to the response. It hides io.ReaderFrom of
+// the underlying writer, so downloads don't take the sendfile path.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := min(len(b), t.limiter.Burst())
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// throttledReader limits the rate the request body is read at, TCP flow control
+// slows down the client accordingly
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > t.limiter.Burst() {
+		b = b[:t.limiter.Burst()]
+	}
+	n, err := t.ReadCloser.Read(b)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
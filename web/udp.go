@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	udpTokenSize = 16
+	// token, sequence number, client send time and server receive time
+	udpProbeHeaderSize = udpTokenSize + 4 + 8 + 8
+	udpMaxProbeSize    = 1500
+	udpSessionLifetime = 5 * time.Minute
+	// limits on live sessions, so that handshakes can't exhaust memory
+	udpMaxSessions      = 10000
+	udpMaxSessionsPerIP = 8
+)
+
+var (
+	errUDPSessionsPerIP = errors.New("too many UDP sessions for the client")
+	errUDPSessions      = errors.New("too many UDP sessions")
+)
+
+// udpSession is created over HTTP before probing, so the responder only ever
+// echoes to addresses that asked for it and can't be used for reflection
+type udpSession struct {
+	addr    netip.Addr
+	expires time.Time
+	tracker *sequenceTracker
+}
+
+type udpSessionResponse struct {
+	Session string `json:"session"`
+	Port    int    `json:"port"`
+	Expires int64  `json:"expires"`
+}
+
+type udpStatsResponse struct {
+	Upstream sequenceStats `json:"upstream"`
+}
+
+type udpEchoServer struct {
+	port int
+
+	mu        sync.Mutex
+	sessions  map[[udpTokenSize]byte]*udpSession
+	perIP     map[netip.Addr]int
+	lastSweep time.Time
+}
+
+// udpEcho is nil unless udp_port is configured
+var udpEcho *udpEchoServer
+
+// startUDPEcho listens on the configured UDP port and echoes probes until ctx is done.
+//
+// A probe starts with the session token, a big endian uint32 sequence number and the
+// client's big endian uint64 send time in Unix nanoseconds, followed by 8 bytes the
+// server fills with its receive time before sending the probe back unchanged otherwise.
+func startUDPEcho(ctx context.Context, addr string) (*udpEchoServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP %s: %w", addr, err)
+	}
+	s := &udpEchoServer{
+		port:     conn.LocalAddr().(*net.UDPAddr).Port,
+		sessions: make(map[[udpTokenSize]byte]*udpSession),
+		perIP:    make(map[netip.Addr]int),
+	}
+	slog.Info("Starting UDP echo responder on", "address", conn.LocalAddr().String())
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	go s.serve(conn)
+	return s, nil
+}
+
+func (s *udpEchoServer) serve(conn net.PacketConn) {
+	buf := make([]byte, udpMaxProbeSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			slog.Info("UDP echo responder closed", slog.Any("error", err))
+			return
+		}
+		received := time.Now()
+		if n < udpProbeHeaderSize {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		var token [udpTokenSize]byte
+		copy(token[:], buf)
+		sess := s.session(token)
+		if sess == nil || sess.addr != udpAddr.AddrPort().Addr().Unmap() {
+			continue
+		}
+
+		probe := buf[udpTokenSize:n]
+		seq := binary.BigEndian.Uint32(probe)
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(probe[4:])))
+		sess.tracker.add(seq, sent, received)
+		binary.BigEndian.PutUint64(probe[12:], uint64(received.UnixNano()))
+
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			slog.Debug("echoing UDP probe", slog.Any("error", err))
+		}
+	}
+}
+
+func (s *udpEchoServer) session(token [udpTokenSize]byte) *udpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok || time.Now().After(sess.expires) {
+		return nil
+	}
+	return sess
+}
+
+func (s *udpEchoServer) newSession(addr netip.Addr) ([udpTokenSize]byte, *udpSession, error) {
+	var token [udpTokenSize]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		panic(fmt.Errorf("failed to generate UDP session token: %s", err))
+	}
+	now := time.Now()
+	sess := &udpSession{
+		addr:    addr,
+		expires: now.Add(udpSessionLifetime),
+		tracker: newSequenceTracker(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// expired sessions count towards the limits until the next sweep
+	if now.Sub(s.lastSweep) > time.Second {
+		s.sweep(now)
+	}
+	if s.perIP[addr] >= udpMaxSessionsPerIP {
+		return token, nil, errUDPSessionsPerIP
+	}
+	if len(s.sessions) >= udpMaxSessions {
+		return token, nil, errUDPSessions
+	}
+	s.sessions[token] = sess
+	s.perIP[addr]++
+	return token, sess, nil
+}
+
+// sweep removes expired sessions, s.mu must be held
+func (s *udpEchoServer) sweep(now time.Time) {
+	for k, v := range s.sessions {
+		if now.After(v.expires) {
+			delete(s.sessions, k)
+			if s.perIP[v.addr]--; s.perIP[v.addr] <= 0 {
+				delete(s.perIP, v.addr)
+			}
+		}
+	}
+	s.lastSweep = now
+}
+
+// udpHandshake creates a probing session on POST, and returns the upstream statistics
+// of an existing session on GET with ?session=<token>&sent=<number of probes sent>
+func udpHandshake(w http.ResponseWriter, r *http.Request) {
+	if udpEcho == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		var token [udpTokenSize]byte
+		b, err := hex.DecodeString(r.FormValue("session"))
+		if err != nil || len(b) != udpTokenSize {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		copy(token[:], b)
+		sess := udpEcho.session(token)
+		if sess == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sent, _ := strconv.Atoi(r.FormValue("sent"))
+		render.JSON(w, r, udpStatsResponse{Upstream: sess.tracker.stats(sent)})
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		slog.Error("parsing client address for UDP session", slog.Any("error", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, sess, err := udpEcho.newSession(addr.Unmap())
+	if err != nil {
+		slog.Debug("creating UDP session", slog.Any("error", err))
+		if errors.Is(err, errUDPSessionsPerIP) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return
+	}
+	render.JSON(w, r, udpSessionResponse{
+		Session: hex.EncodeToString(token[:]),
+		Port:    udpEcho.port,
+		Expires: sess.expires.Unix(),
+	})
+}
@@ -2,44 +2,129 @@ package web
 
 import (
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"hash"
 	"io/fs"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/render"
 
 	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database"
 	"github.com/librespeed/speedtest/results"
+	"github.com/librespeed/speedtest/session"
+	"github.com/librespeed/speedtest/tcpconn"
+	"github.com/librespeed/speedtest/token"
 )
 
 const (
-	// chunk size is 1 mib
+	// default chunk size is 1 mib
 	chunkSize = 1048576
+	// default download size limit, 1024 chunks
+	defaultMaxDownloadSize = 1024 * chunkSize
+
+	// trailer carrying the amount of data sent by a duration bounded download
+	bytesSentTrailer = "X-Bytes-Sent"
 )
 
 //go:embed assets
 var defaultAssets embed.FS
 
 var (
-	// generate random data for download test on start to minimize runtime overhead
+	// generate random data for download test on start to minimize runtime overhead,
+	// ListenAndServe replaces it if chunk_size is configured otherwise
 	randomData = getRandomData(chunkSize)
+
+	// largest amount of data sent by a single download, and accepted by a single upload if positive
+	maxDownloadSize int64 = defaultMaxDownloadSize
+	maxUploadSize   int64
+
+	// daily traffic limits, nil if not configured
+	quotas *quotaTracker
 )
 
+// configureSizes applies chunk_size, max_download_size and max_upload_size, the first two
+// keep their defaults if empty
+func configureSizes(conf *config.Config) error {
+	size := int64(chunkSize)
+	if conf.ChunkSize != "" {
+		n, err := parseSize(conf.ChunkSize)
+		if err != nil {
+			return fmt.Errorf("chunk_size: %w", err)
+		}
+		size = n
+	}
+	// a chunk is kept in memory, and sent as a single websocket message
+	if size <= 0 || size > 1<<30 {
+		return fmt.Errorf("chunk_size out of range: %s", conf.ChunkSize)
+	}
+	if size != int64(len(randomData)) {
+		randomData = getRandomData(int(size))
+	}
+
+	maxDownloadSize = defaultMaxDownloadSize
+	if conf.MaxDownloadSize != "" {
+		n, err := parseSize(conf.MaxDownloadSize)
+		if err != nil {
+			return fmt.Errorf("max_download_size: %w", err)
+		}
+		maxDownloadSize = n
+	}
+	if maxDownloadSize < size {
+		return fmt.Errorf("max_download_size must be at least chunk_size")
+	}
+	maxUploadSize = 0
+	if conf.MaxUploadSize != "" {
+		n, err := parseSize(conf.MaxUploadSize)
+		if err != nil {
+			return fmt.Errorf("max_upload_size: %w", err)
+		}
+		maxUploadSize = n
+	}
+	return nil
+}
+
 func ListenAndServe(ctx context.Context, conf *config.Config) error {
+	// before anything uses randomData, like the memfd for zero-copy downloads
+	if err := configureSizes(conf); err != nil {
+		return err
+	}
+	threshold, err := parseSize(conf.PowThreshold)
+	if err != nil {
+		return fmt.Errorf("pow_threshold: %w", err)
+	}
+	powThreshold = threshold
+	q, err := newQuotaTracker(conf, database.DB)
+	if err != nil {
+		return err
+	}
+	quotas = q
+	go quotas.run(ctx, conf.QuotaFlushInterval)
+
+	proxies, err := parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
 	r := chi.NewRouter()
-	r.Use(middleware.RealIP)
+	r.Use(proxies.realIP(conf.RealIPHeader))
 	r.Use(middleware.GetHead)
 
 	cs := cors.New(cors.Options{
@@ -49,8 +134,8 @@ func ListenAndServe(ctx context.Context, conf *config.Config) error {
 	})
 
 	r.Use(cs.Handler)
-	r.Use(middleware.NoCache)
 	r.Use(middleware.Recoverer)
+	r.Use(congestionControl)
 
 	var assetFS http.FileSystem
 	if fi, err := os.Stat(conf.AssetsPath); os.IsNotExist(err) || !fi.IsDir() {
@@ -64,38 +149,98 @@ func ListenAndServe(ctx context.Context, conf *config.Config) error {
 	} else {
 		assetFS = justFilesFilesystem{fs: http.Dir(conf.AssetsPath), readDirBatchSize: 2}
 	}
+	files, err := newTestFiles(conf.TestFiles)
+	if err != nil {
+		return err
+	}
+	testFiles = files
+	go hashTestFiles(ctx, files)
+
+	if conf.UDPPort != "" {
+		echo, err := startUDPEcho(ctx, net.JoinHostPort(conf.BindAddress, conf.UDPPort))
+		if err != nil {
+			return err
+		}
+		udpEcho = echo
+	}
+
 	base := conf.BaseURL
 	if base == "" {
 		base = "/"
 	}
 	r.Route(base, func(r chi.Router) {
-		r.Get("/*", pages(assetFS, conf.BaseURL))
-		r.HandleFunc("/empty", empty)
-		r.HandleFunc("/backend/empty", empty)
-		r.Get("/garbage", garbage)
-		r.Get("/backend/garbage", garbage)
-		r.Get("/getIP", getIP)
-		r.Get("/backend/getIP", getIP)
-		r.Get("/results", results.DrawPNG)
-		r.Get("/results/", results.DrawPNG)
-		r.Get("/backend/results", results.DrawPNG)
-		r.Get("/backend/results/", results.DrawPNG)
-		r.Post("/results/telemetry", results.Record)
-		r.Post("/backend/results/telemetry", results.Record)
-		r.HandleFunc("/stats", results.Stats)
-		r.HandleFunc("/backend/stats", results.Stats)
-
-		// PHP frontend default values compatibility
-		r.HandleFunc("/empty.php", empty)
-		r.HandleFunc("/backend/empty.php", empty)
-		r.Get("/garbage.php", garbage)
-		r.Get("/backend/garbage.php", garbage)
-		r.Get("/getIP.php", getIP)
-		r.Get("/backend/getIP.php", getIP)
-		r.Post("/results/telemetry.php", results.Record)
-		r.Post("/backend/results/telemetry.php", results.Record)
-		r.HandleFunc("/stats.php", results.Stats)
-		r.HandleFunc("/backend/stats.php", results.Stats)
+		limiter := newRateLimiter(conf)
+		admission := newTestAdmission(conf)
+
+		// test files skip middleware.NoCache, which strips the request headers their conditional
+		// and resumed downloads rely on
+		f := r.With(limiter.Handler, admission.Handler)
+		f.Get("/files/{name}", testFileHandler)
+		f.Get("/backend/files/{name}", testFileHandler)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.NoCache)
+			// endpoints creating state on the server, or sending or receiving test data
+			l := r.With(limiter.Handler)
+			// endpoints sending or receiving test data
+			t := l.With(admission.Handler)
+			// the ones that can emulate slower links
+			s := t.With(shaping)
+
+			r.Get("/*", pages(assetFS, conf.BaseURL))
+			s.HandleFunc("/empty", empty)
+			s.HandleFunc("/backend/empty", empty)
+			s.Get("/garbage", garbage)
+			s.Get("/backend/garbage", garbage)
+			l.Get("/getIP", getIP)
+			r.Get("/pow/challenge", powChallenge)
+			r.Get("/backend/pow/challenge", powChallenge)
+			r.Get("/queue", admission.Poll)
+			r.Get("/backend/queue", admission.Poll)
+			r.Get("/time", timestamps)
+			r.Get("/backend/time", timestamps)
+			l.Post("/session", createSession)
+			l.Post("/backend/session", createSession)
+			r.Get("/session/report", sessionReport)
+			r.Get("/backend/session/report", sessionReport)
+			r.Get("/latency/ping", latencyPing)
+			r.Get("/backend/latency/ping", latencyPing)
+			r.Get("/latency/result", latencyResult)
+			r.Get("/backend/latency/result", latencyResult)
+			l.Get("/backend/getIP", getIP)
+			t.Get("/ws", websocketTest)
+			t.Get("/backend/ws", websocketTest)
+			t.Get("/ndt/v7/download", ndt7Download)
+			t.Get("/ndt/v7/upload", ndt7Upload)
+			t.Get("/backend/ndt/v7/download", ndt7Download)
+			t.Get("/backend/ndt/v7/upload", ndt7Upload)
+			t.Connect("/webtransport", datagramTest)
+			t.Connect("/backend/webtransport", datagramTest)
+			l.Get("/udp", udpHandshake)
+			l.Post("/udp", udpHandshake)
+			l.Get("/backend/udp", udpHandshake)
+			l.Post("/backend/udp", udpHandshake)
+			r.Get("/results", results.DrawPNG)
+			r.Get("/results/", results.DrawPNG)
+			r.Get("/backend/results", results.DrawPNG)
+			r.Get("/backend/results/", results.DrawPNG)
+			r.Post("/results/telemetry", results.Record)
+			r.Post("/backend/results/telemetry", results.Record)
+			r.HandleFunc("/stats", results.Stats)
+			r.HandleFunc("/backend/stats", results.Stats)
+
+			// PHP frontend default values compatibility
+			s.HandleFunc("/empty.php", empty)
+			s.HandleFunc("/backend/empty.php", empty)
+			s.Get("/garbage.php", garbage)
+			s.Get("/backend/garbage.php", garbage)
+			l.Get("/getIP.php", getIP)
+			l.Get("/backend/getIP.php", getIP)
+			r.Post("/results/telemetry.php", results.Record)
+			r.Post("/backend/results/telemetry.php", results.Record)
+			r.HandleFunc("/stats.php", results.Stats)
+			r.HandleFunc("/backend/stats.php", results.Stats)
+		})
 	})
 
 	return startListener(ctx, conf, r)
@@ -119,16 +264,98 @@ func pages(fs http.FileSystem, BaseURL string) http.HandlerFunc {
 	return fn
 }
 
+// uploadMeasurement is the server's view of an upload, returned by empty when asked with measure=true
+type uploadMeasurement struct {
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	Mbps       float64 `json:"mbps"`
+	// hex encoded digest of the body, if requested with ?digest=sha256 or ?digest=xxhash
+	Digest          string `json:"digest,omitempty"`
+	DigestAlgorithm string `json:"digestAlgorithm,omitempty"`
+}
+
+// uploadDigests are the algorithms empty can hash uploads with.
+// xxhash is XXH64 with seed 0, as printed by xxhsum.
+var uploadDigests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
 func empty(w http.ResponseWriter, r *http.Request) {
-	_, err := io.Copy(io.Discard, r.Body)
+	sess, ok := requestSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// query string only, FormValue would try to parse the upload body
+	query := r.URL.Query()
+	var h hash.Hash
+	algorithm := query.Get("digest")
+	if algorithm != "" {
+		newHash, ok := uploadDigests[algorithm]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h = newHash()
+	}
+
+	transfer := sess.StartTransfer(session.Upload)
+	defer transfer.Done()
+
+	ip := remoteIP(r)
+	m := quotas.meter(ip, session.Upload)
+	defer m.finish()
+	// uploads of known length are refused up front if the quota can't take all of them
+	want := r.ContentLength
+	if maxUploadSize > 0 {
+		want = min(want, maxUploadSize)
+	}
+	if want > 0 && m.allow(want) < want {
+		quotaExceeded(w)
+		return
+	}
+	if maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+	start := time.Now()
+	n, err := drainBody(quotaReader{r: r.Body, m: m}, h)
+	elapsed := time.Since(start)
+	transfer.Add(n)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, errQuotaExceeded):
+			quotaExceeded(w)
+		case errors.As(err, &tooLarge):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		return
 	}
 	_ = r.Body.Close()
 
 	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(http.StatusOK)
+
+	// a digest can't be returned without a body
+	if query.Get("measure") != "true" && h == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ret := uploadMeasurement{
+		Bytes:      n,
+		DurationMs: float64(elapsed.Microseconds()) / 1000,
+	}
+	if elapsed > 0 {
+		ret.Mbps = float64(n*8) / elapsed.Seconds() / 1e6
+	}
+	if h != nil {
+		ret.Digest = hex.EncodeToString(h.Sum(nil))
+		ret.DigestAlgorithm = algorithm
+	}
+	render.JSON(w, r, ret)
 }
 
 func garbage(w http.ResponseWriter, r *http.Request) {
@@ -137,9 +364,32 @@ func garbage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", "attachment; filename=random.dat")
 	w.Header().Set("Content-Transfer-Encoding", "binary")
 
+	sess, ok := requestSession(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	transfer := sess.StartTransfer(session.Download)
+	defer transfer.Done()
+	ip := remoteIP(r)
+
 	// chunk size set to 4 by default
 	chunks := 4
 
+	// size of each chunk, up to chunk_size
+	size := len(randomData)
+	if v := r.FormValue("chunkSize"); v != "" {
+		n, err := parseSize(v)
+		if err != nil || n <= 0 || n > int64(len(randomData)) {
+			slog.Debug("Invalid chunk size", slog.String("chunkSize", v), slog.Int("max", len(randomData)))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		size = int(n)
+	}
+	// limit the number of chunks to max_download_size
+	maxChunks := int(min(maxDownloadSize/int64(size), math.MaxInt32))
+
 	ckSize := r.FormValue("ckSize")
 	if ckSize != "" {
 		i, err := strconv.ParseInt(ckSize, 10, 64)
@@ -147,25 +397,130 @@ func garbage(w http.ResponseWriter, r *http.Request) {
 			slog.Error("Invalid chunk size: %s", slog.Any("ckSize", ckSize))
 			slog.Warn("Will use default value %d", slog.Any("ckSize", chunks))
 		} else {
-			// limit max chunk size to 1024
-			if i > 1024 {
-				chunks = 1024
+			if i > int64(maxChunks) {
+				chunks = maxChunks
 			} else {
 				chunks = int(i)
 			}
 		}
 	}
 
-	for i := 0; i < chunks; i++ {
-		if _, err := w.Write(randomData); err != nil {
-			slog.Error("Error writing back to client",
-				slog.Any("chunk number", i),
-				slog.Any("error", err),
-			)
+	unique := config.LoadedConfig().UniquePayload || r.FormValue("unique") == "true"
+	payload := payloadFunc(staticPayload)
+	if unique {
+		ks := newKeystream()
+		defer ks.release()
+		payload = ks.next
+	}
+	if size < len(randomData) {
+		full := payload
+		payload = func() []byte { return full()[:size] }
+	}
+
+	if d := r.FormValue("duration"); d != "" {
+		duration, err := parseDownloadDuration(d)
+		if err != nil {
+			slog.Error("Invalid download duration", slog.String("duration", d), slog.Any("error", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if max := config.LoadedConfig().MaxDownloadDuration; max > 0 && duration > max {
+			duration = max
+		}
+
+		// the amount of data is only bounded by the duration, max_download_size applies to ckSize
+		pm, ok := requirePoW(w, r, int64(size))
+		if !ok {
+			return
+		}
+		defer pm.finish()
+		m := quotas.meter(ip, session.Download)
+		defer m.finish()
+		if m.allow(int64(size)) == 0 {
+			quotaExceeded(w)
+			return
+		}
+		// the amount of data isn't known up front, so it is reported in a trailer
+		w.Header().Set("Trailer", bytesSentTrailer)
+		sent := garbageFor(w, r, payload, duration, m, pm)
+		transfer.Add(sent)
+		w.Header().Set(bytesSentTrailer, strconv.FormatInt(sent, 10))
+		slog.Debug("Duration bounded download finished",
+			slog.Duration("duration", duration),
+			slog.Int64("bytes", sent))
+		return
+	}
+
+	if chunks < 0 {
+		chunks = 0
+	}
+	want := int64(chunks) * int64(size)
+	pm, ok := requirePoW(w, r, want)
+	if !ok {
+		return
+	}
+	defer pm.finish()
+	granted := quotas.reserve(ip, session.Download, want)
+	if granted < want {
+		// send as many whole chunks as the quota allows
+		if chunks = int(granted / int64(size)); chunks == 0 {
+			quotas.finish(ip, session.Download, granted, 0)
+			quotaExceeded(w)
+			return
+		}
+	}
+	// a known length lets net/http hand the body to sendfile instead of chunking it
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(chunks)*int64(size), 10))
+	var sent int64
+	if unique {
+		sent = writeChunks(w, payload, chunks)
+	} else {
+		sent = writeStaticChunks(w, chunks, size)
+	}
+	transfer.Add(sent)
+	pm.add(sent)
+	quotas.finish(ip, session.Download, granted, sent)
+}
 
+// garbageFor keeps writing random data until the duration has passed, the quota of m or the
+// proof-of-work budget of pm is used up or the client went away, and returns the number of
+// bytes written
+func garbageFor(w http.ResponseWriter, r *http.Request, payload payloadFunc, duration time.Duration, m *quotaMeter, pm *powMeter) int64 {
+	var sent int64
+	deadline := time.Now().Add(duration)
+	ctx := r.Context()
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		b := payload()
+		allowed := pm.allow(m.allow(int64(len(b))))
+		if allowed == 0 {
+			break
+		}
+		n, err := w.Write(b[:allowed])
+		sent += int64(n)
+		m.add(int64(n))
+		pm.add(int64(n))
+		if err != nil {
+			slog.Debug("Client stopped duration bounded download", slog.Any("error", err))
 			break
 		}
 	}
+	return sent
+}
+
+// parseDownloadDuration accepts Go durations such as "10s" as well as plain seconds
+func parseDownloadDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(s, 64)
+		if serr != nil {
+			return 0, err
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return d, nil
 }
 
 func getIP(w http.ResponseWriter, r *http.Request) {
@@ -179,6 +534,22 @@ func getIP(w http.ResponseWriter, r *http.Request) {
 		clientIP = ip
 	}
 
+	if info, err := tcpconn.ReadRequestInfo(r); err == nil {
+		ret.TCPInfo = info
+	} else if !errors.Is(err, tcpconn.ErrUnsupported) {
+		slog.Debug("reading TCP_INFO", slog.Any("error", err))
+	}
+	ret.Token = token.Issue(clientIP)
+	// verified telemetry needs the test's transfers to be linked to a session
+	if config.LoadedConfig().TelemetryVerification != "off" {
+		// without a session the results of the test can't be verified
+		if s, err := session.New(clientIP); err == nil {
+			ret.Session = s.ID
+		} else {
+			slog.Debug("creating session", slog.String("ip", clientIP), slog.Any("error", err))
+		}
+	}
+
 	isSpecialIP := true
 	switch {
 	case clientIP == "::1":
@@ -1,8 +1,44 @@
 package web
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/database/memory"
+	"github.com/librespeed/speedtest/database/schema"
+	"github.com/librespeed/speedtest/pow"
+	"github.com/librespeed/speedtest/results"
+	"github.com/librespeed/speedtest/session"
+	"github.com/librespeed/speedtest/tcpconn"
 )
 
 func TestTrimPrefix(t *testing.T) {
@@ -40,3 +76,1257 @@ func BenchmarkTrimPrefixReg(b *testing.B) {
 		removeBaseURL.ReplaceAllString("/foo/bar", "/foo")
 	}
 }
+
+func TestWebsocketTest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(websocketTest))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(wsRequest{Action: "ping", ID: 42}); err != nil {
+		t.Fatalf("write ping: %v", err)
+	}
+	var resp wsResponse
+	if err := conn.ReadJSON(&resp); err != nil || resp.Type != "pong" || resp.ID != 42 {
+		t.Fatalf("ping response = %+v, %v", resp, err)
+	}
+
+	if err := conn.WriteJSON(wsRequest{Action: "download", Chunks: 2}); err != nil {
+		t.Fatalf("write download: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		typ, b, err := conn.ReadMessage()
+		if err != nil || typ != websocket.BinaryMessage || len(b) != chunkSize {
+			t.Fatalf("download frame %d: type %d, len %d, %v", i, typ, len(b), err)
+		}
+	}
+	if err := conn.ReadJSON(&resp); err != nil || resp.Type != "download" || resp.Bytes != 2*chunkSize {
+		t.Fatalf("download summary = %+v, %v", resp, err)
+	}
+
+	if err := conn.WriteJSON(wsRequest{Action: "upload"}); err != nil {
+		t.Fatalf("write upload: %v", err)
+	}
+	if err := conn.ReadJSON(&resp); err != nil || resp.Type != "upload" {
+		t.Fatalf("upload start = %+v, %v", resp, err)
+	}
+	for i, want := range []int64{1000, 3000} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 1000*(i+1))); err != nil {
+			t.Fatalf("write upload frame: %v", err)
+		}
+		if err := conn.ReadJSON(&resp); err != nil || resp.Bytes != want {
+			t.Fatalf("upload ack = %+v, %v, want %d bytes", resp, err, want)
+		}
+	}
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { config.LoadedConfig().TestIdleTimeout = d }(config.LoadedConfig().TestIdleTimeout)
+	config.LoadedConfig().TestIdleTimeout = 100 * time.Millisecond
+
+	// the handler has to be done before the configuration is restored
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		websocketTest(w, r)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("idle connection wasn't closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("idle connection still open: %v", err)
+	}
+	<-done
+}
+
+func TestNDT7Upload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(ndt7Upload))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("dial without subprotocol = %v, %v", resp, err)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{ndt7Subprotocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var m ndt7Measurement
+	if err := conn.ReadJSON(&m); err != nil || m.Test != "upload" || m.Origin != "server" || m.ConnectionInfo == nil {
+		t.Fatalf("first measurement = %+v, %v", m, err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, ndt7MinMessageSize)); err != nil {
+			t.Fatalf("write upload message: %v", err)
+		}
+	}
+	for m.AppInfo.NumBytes < 4*ndt7MinMessageSize {
+		m = ndt7Measurement{}
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("read measurement: %v", err)
+		}
+		if m.ConnectionInfo != nil {
+			t.Fatalf("ConnectionInfo sent again: %+v", m)
+		}
+	}
+	if m.AppInfo.NumBytes != 4*ndt7MinMessageSize {
+		t.Fatalf("NumBytes = %d", m.AppInfo.NumBytes)
+	}
+	if runtime.GOOS == "linux" && (m.TCPInfo == nil || m.TCPInfo.BytesReceived == 0) {
+		t.Fatalf("TCPInfo = %+v", m.TCPInfo)
+	}
+}
+
+func TestNDT7Download(t *testing.T) {
+	// downloads have to be done before the quotas and budgets they use are replaced
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		ndt7Download(w, r)
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// run reads a download to its end, it returns the bytes received and the last measurement
+	run := func() (int64, ndt7Measurement) {
+		dialer := websocket.Dialer{Subprotocols: []string{ndt7Subprotocol}}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+
+		var received int64
+		var last ndt7Measurement
+		for i := 0; ; i++ {
+			typ, b, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					t.Fatalf("read: %v", err)
+				}
+				_ = conn.Close()
+				handlers.Wait()
+				return received, last
+			}
+			if typ == websocket.BinaryMessage {
+				received += int64(len(b))
+				continue
+			}
+			last = ndt7Measurement{}
+			if err := json.Unmarshal(b, &last); err != nil || last.Test != "download" || last.Origin != "server" {
+				t.Fatalf("measurement %q: %v", b, err)
+			}
+			if (i == 0) != (last.ConnectionInfo != nil) {
+				t.Fatalf("ConnectionInfo in message %d: %+v", i, last.ConnectionInfo)
+			}
+		}
+	}
+
+	// the stream stops once the download quota is used up
+	store, _ := memory.Open(schema.Config{})
+	q, err := newQuotaTracker(&config.Config{QuotaDownloadPerIP: "256KB"}, store)
+	if err != nil {
+		t.Fatalf("newQuotaTracker: %v", err)
+	}
+	quotas = q
+	received, last := run()
+	quotas = nil
+	if received == 0 || received > 256<<10 || last.AppInfo.NumBytes != received {
+		t.Errorf("download within quota: received %d bytes, last measurement %+v", received, last.AppInfo)
+	}
+
+	// and once the proof-of-work budget is
+	pow.Initialize(&config.Config{PowDifficulty: 4})
+	powThreshold = 64 << 10
+	defer func() {
+		pow.Initialize(&config.Config{})
+		powThreshold = 0
+		powBudgets = &powBudgetTracker{clients: make(map[string]*powBudget)}
+	}()
+	received, last = run()
+	if received == 0 || received > 64<<10 || last.AppInfo.NumBytes != received {
+		t.Errorf("download within proof-of-work budget: received %d bytes, last measurement %+v", received, last.AppInfo)
+	}
+	if _, resp, err := (&websocket.Dialer{Subprotocols: []string{ndt7Subprotocol}}).Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("download beyond the budget: %v, %v", resp, err)
+	}
+	handlers.Wait()
+}
+
+func TestGetIPTCPInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only read on Linux")
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(getIP))
+	srv.Config.ConnContext = tcpconn.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	var ret results.Result
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if ret.TCPInfo == nil || ret.TCPInfo.RTT == 0 || ret.TCPInfo.SndMSS == 0 {
+		t.Fatalf("tcpInfo = %+v", ret.TCPInfo)
+	}
+}
+
+func TestCongestionControl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("congestion control is only configurable on Linux")
+	}
+	config.LoadedConfig().TCPAllowedCongestionControls = []string{"reno"}
+	defer func() { config.LoadedConfig().TCPAllowedCongestionControls = nil }()
+
+	srv := httptest.NewUnstartedServer(congestionControl(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := tcpconn.CongestionControl(tcpconn.FromRequest(r))
+		if err != nil {
+			t.Errorf("reading congestion control: %v", err)
+		}
+		_, _ = io.WriteString(w, name)
+	})))
+	srv.Config.ConnContext = tcpconn.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	get := func(query string) (int, string) {
+		resp, err := srv.Client().Get(srv.URL + query)
+		if err != nil {
+			t.Fatalf("get %s: %v", query, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	_, initial := get("/")
+	if code, name := get("/?cc=reno"); code != http.StatusOK || name != "reno" {
+		t.Fatalf("?cc=reno: %d %q", code, name)
+	}
+	// the keep-alive connection goes back to its previous algorithm
+	if _, name := get("/"); name != initial {
+		t.Fatalf("after ?cc=reno: %q, want %q", name, initial)
+	}
+	if code, _ := get("/?cc=cubic"); code != http.StatusBadRequest {
+		t.Fatalf("?cc=cubic not in allowed list: %d", code)
+	}
+}
+
+func TestLatencySession(t *testing.T) {
+	w := httptest.NewRecorder()
+	createSession(w, httptest.NewRequest(http.MethodPost, "/session", nil))
+	var sess sessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil || sess.Session == "" {
+		t.Fatalf("create session: %q, %v", w.Body.String(), err)
+	}
+
+	ping := func(query string) latencyPingResponse {
+		w := httptest.NewRecorder()
+		latencyPing(w, httptest.NewRequest(http.MethodGet, "/latency/ping?session="+sess.Session+query, nil))
+		var ret latencyPingResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+			t.Fatalf("ping: %d %q, %v", w.Code, w.Body.String(), err)
+		}
+		return ret
+	}
+	p := ping("")
+	if p.Phase != session.Idle {
+		t.Fatalf("first probe phase = %s", p.Phase)
+	}
+	ping("&seq=" + strconv.FormatUint(p.Seq, 10) + "&rtt=12.5")
+
+	w = httptest.NewRecorder()
+	latencyResult(w, httptest.NewRequest(http.MethodGet, "/latency/result?session="+sess.Session, nil))
+	var res session.LatencyResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Idle.Samples != 1 || res.Idle.MedianMs != 12.5 {
+		t.Fatalf("result = %q, %v", w.Body.String(), err)
+	}
+
+	// sessions are bound to the client that created them
+	req := httptest.NewRequest(http.MethodGet, "/latency/ping?session="+sess.Session, nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	w = httptest.NewRecorder()
+	latencyPing(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("ping from another client: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	garbage(w, httptest.NewRequest(http.MethodGet, "/garbage?ckSize=1&session=unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("garbage with unknown session: %d", w.Code)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	t1 := time.Now().UnixNano()
+	w := httptest.NewRecorder()
+	timestamps(w, httptest.NewRequest(http.MethodGet, "/time?t1="+strconv.FormatInt(t1, 10), nil))
+	var ret timestampsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if ret.T1 != t1 || ret.T2 < t1 || ret.T3 < ret.T2 {
+		t.Fatalf("timestamps = %+v, t1 %d", ret, t1)
+	}
+
+	w = httptest.NewRecorder()
+	timestamps(w, httptest.NewRequest(http.MethodGet, "/time?t1=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid t1: %d", w.Code)
+	}
+}
+
+func TestSessionReport(t *testing.T) {
+	s, _ := session.New("192.0.2.1")
+	for range 3 {
+		garbage(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/garbage?ckSize=2&session="+s.ID, nil))
+	}
+	empty(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/empty?session="+s.ID, strings.NewReader("upload")))
+
+	w := httptest.NewRecorder()
+	sessionReport(w, httptest.NewRequest(http.MethodGet, "/session/report?session="+s.ID, nil))
+	var got session.Report
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if got.Download.Streams != 3 || got.Download.Bytes != 3*2*int64(len(randomData)) {
+		t.Errorf("download = %+v", got.Download)
+	}
+	if got.Upload.Streams != 1 || got.Upload.Bytes != 6 {
+		t.Errorf("upload = %+v", got.Upload)
+	}
+}
+
+func TestTestFiles(t *testing.T) {
+	files, err := newTestFiles([]string{"64KB", "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFiles = files
+	defer func() { testFiles = nil }()
+	if _, err := newTestFiles([]string{"100XB"}); err == nil {
+		t.Fatal("invalid size accepted")
+	}
+
+	r := chi.NewRouter()
+	r.Get("/files/{name}", testFileHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(name string, header http.Header) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/files/"+name, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", name, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	resp, full := get("64KB.bin", nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || len(full) != 64<<10 || etag == "" {
+		t.Fatalf("full download: %d, %d bytes, etag %q", resp.StatusCode, len(full), etag)
+	}
+	if _, again := get("64KB.bin", nil); !bytes.Equal(full, again) {
+		t.Fatal("content is not deterministic")
+	}
+
+	// resuming from an offset that isn't block aligned
+	resp, part := get("64KB.bin", http.Header{"Range": {"bytes=1000-"}, "If-Range": {etag}})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(part, full[1000:]) {
+		t.Fatalf("range download: %d, %d bytes", resp.StatusCode, len(part))
+	}
+	if resp, _ := get("64KB.bin", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional download: %d", resp.StatusCode)
+	}
+
+	if resp, _ := get(testFileChecksums, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("checksums before hashing: %d", resp.StatusCode)
+	}
+	hashTestFiles(context.Background(), files)
+	sum := sha256.Sum256(full)
+	_, sums := get(testFileChecksums, nil)
+	if !strings.Contains(string(sums), hex.EncodeToString(sum[:])+"  64KB.bin\n") || !strings.Contains(string(sums), "  1MB.bin\n") {
+		t.Fatalf("checksums:\n%s", sums)
+	}
+	if _, single := get("64KB.bin.sha256", nil); string(single) != hex.EncodeToString(sum[:])+"  64KB.bin\n" {
+		t.Fatalf("checksum: %q", single)
+	}
+	if resp, _ := get("2MB.bin", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown file: %d", resp.StatusCode)
+	}
+}
+
+func TestEmptyMeasure(t *testing.T) {
+	body := strings.Repeat("x", 4096)
+
+	w := httptest.NewRecorder()
+	empty(w, httptest.NewRequest(http.MethodPost, "/empty", strings.NewReader(body)))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("plain empty: code %d, body %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	empty(w, httptest.NewRequest(http.MethodPost, "/empty?measure=true", strings.NewReader(body)))
+	var got uploadMeasurement
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding measurement %q: %v", w.Body.String(), err)
+	}
+	if got.Bytes != int64(len(body)) {
+		t.Errorf("measured %d bytes, want %d", got.Bytes, len(body))
+	}
+
+	sum := sha256.Sum256([]byte(body))
+	for algorithm, want := range map[string]string{
+		"sha256": hex.EncodeToString(sum[:]),
+		"xxhash": fmt.Sprintf("%016x", xxhash.Sum64String(body)),
+	} {
+		w = httptest.NewRecorder()
+		empty(w, httptest.NewRequest(http.MethodPost, "/empty?digest="+algorithm, strings.NewReader(body)))
+		got = uploadMeasurement{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding %s digest %q: %v", algorithm, w.Body.String(), err)
+		}
+		if got.Digest != want || got.DigestAlgorithm != algorithm || got.Bytes != int64(len(body)) {
+			t.Errorf("%s digest = %+v, want %s", algorithm, got, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	empty(w, httptest.NewRequest(http.MethodPost, "/empty?digest=md5", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported digest: %d", w.Code)
+	}
+}
+
+func TestPayloadLimits(t *testing.T) {
+	if err := configureSizes(&config.Config{ChunkSize: "1MB", MaxDownloadSize: "3MB", MaxUploadSize: "1KB"}); err != nil {
+		t.Fatalf("configureSizes: %v", err)
+	}
+	defer func() { maxDownloadSize, maxUploadSize = defaultMaxDownloadSize, 0 }()
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		size  int
+	}{
+		{"ckSize=100", http.StatusOK, 3 * chunkSize},
+		{"ckSize=2&chunkSize=64KB", http.StatusOK, 2 * 64 << 10},
+		{"ckSize=100&chunkSize=512KB", http.StatusOK, 6 * 512 << 10},
+		{"chunkSize=2MB", http.StatusBadRequest, 0},
+		{"chunkSize=0", http.StatusBadRequest, 0},
+		{"chunkSize=lots", http.StatusBadRequest, 0},
+	} {
+		w := httptest.NewRecorder()
+		garbage(w, httptest.NewRequest(http.MethodGet, "/garbage?"+tc.query, nil))
+		if w.Code != tc.code || w.Body.Len() != tc.size {
+			t.Errorf("garbage?%s: code %d, %d bytes, want %d, %d bytes", tc.query, w.Code, w.Body.Len(), tc.code, tc.size)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	empty(w, httptest.NewRequest(http.MethodPost, "/empty", strings.NewReader(strings.Repeat("x", 1024))))
+	if w.Code != http.StatusOK {
+		t.Errorf("upload at the limit: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	empty(w, httptest.NewRequest(http.MethodPost, "/empty", strings.NewReader(strings.Repeat("x", 1025))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the limit: %d", w.Code)
+	}
+
+	// duration bounded downloads aren't limited by max_download_size, the body is discarded
+	w = httptest.NewRecorder()
+	w.Body = nil
+	garbage(w, httptest.NewRequest(http.MethodGet, "/garbage?duration=0.05", nil))
+	if sent, _ := strconv.ParseInt(w.Header().Get(bytesSentTrailer), 10, 64); sent <= maxDownloadSize {
+		t.Errorf("duration bounded download sent %d bytes, want more than max_download_size", sent)
+	}
+
+	if err := configureSizes(&config.Config{ChunkSize: "1MB", MaxDownloadSize: "512KB"}); err == nil {
+		t.Error("max_download_size below chunk_size accepted")
+	}
+	// settings files from before chunk_size and max_download_size existed
+	if err := configureSizes(&config.Config{}); err != nil || len(randomData) != chunkSize || maxDownloadSize != defaultMaxDownloadSize {
+		t.Errorf("defaults: %v, chunk %d, max download %d", err, len(randomData), maxDownloadSize)
+	}
+}
+
+func TestParseDownloadDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"10s", 10 * time.Second, false},
+		{"1m30s", 90 * time.Second, false},
+		{"15", 15 * time.Second, false},
+		{"2.5", 2500 * time.Millisecond, false},
+		{"0", 0, true},
+		{"-5s", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDownloadDuration(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDownloadDuration(%q) = %v, %v, want %v (error: %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestKeystreamDoesNotRepeat(t *testing.T) {
+	a, b := newKeystream(), newKeystream()
+	defer a.release()
+	defer b.release()
+
+	first := bytes.Clone(a.next())
+	if bytes.Equal(first, a.next()) {
+		t.Error("consecutive chunks of the same keystream are equal")
+	}
+	if bytes.Equal(first, b.next()) {
+		t.Error("keystreams of different requests are equal")
+	}
+}
+
+func BenchmarkPayloadStatic(b *testing.B) {
+	b.SetBytes(chunkSize)
+	for i := 0; i < b.N; i++ {
+		_, _ = io.Discard.Write(staticPayload())
+	}
+}
+
+func BenchmarkPayloadKeystream(b *testing.B) {
+	ks := newKeystream()
+	defer ks.release()
+	b.SetBytes(chunkSize)
+	for i := 0; i < b.N; i++ {
+		_, _ = io.Discard.Write(ks.next())
+	}
+}
+
+func BenchmarkGarbage(b *testing.B) {
+	for _, unique := range []string{"false", "true"} {
+		b.Run("unique="+unique, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/garbage?ckSize=4&unique="+unique, nil)
+			b.SetBytes(4 * chunkSize)
+			for i := 0; i < b.N; i++ {
+				garbage(discardResponseWriter{}, req)
+			}
+		})
+	}
+}
+
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header         { return http.Header{} }
+func (discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponseWriter) WriteHeader(int)             {}
+
+func TestSequenceTracker(t *testing.T) {
+	tracker := newSequenceTracker()
+	start := time.Now()
+	// 2 is lost, 4 arrives before 3, 5 is duplicated
+	for i, seq := range []uint32{0, 1, 4, 3, 5, 5} {
+		sent := start.Add(time.Duration(seq) * 10 * time.Millisecond)
+		tracker.add(seq, sent, sent.Add(time.Duration(20+i)*time.Millisecond))
+	}
+
+	got := tracker.stats(6)
+	// the transit time grows by 1ms with every packet received
+	want := sequenceStats{
+		Sent: 6, Received: 5, Lost: 1, LossPercent: 100.0 / 6, Reordered: 1, Duplicates: 1,
+		JitterMs: 1 - math.Pow(15.0/16, 4),
+	}
+	if math.Abs(got.JitterMs-want.JitterMs) > 1e-9 || math.Abs(got.LossPercent-want.LossPercent) > 1e-9 {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	got.LossPercent, got.JitterMs = want.LossPercent, want.JitterMs
+	if got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// duplicates are only detected within the window below the highest sequence number
+	tracker = newSequenceTracker()
+	for _, seq := range []uint32{0, 1, sequenceWindow + 1, 1, 2, sequenceWindow + 2, sequenceWindow + 2} {
+		tracker.add(seq, start, start)
+	}
+	if got := tracker.stats(5); got.Received != 6 || got.Duplicates != 1 || got.Reordered != 2 {
+		t.Errorf("stats after sliding = %+v", got)
+	}
+}
+
+func TestUDPEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echo, err := startUDPEcho(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("starting UDP echo: %v", err)
+	}
+	udpEcho = echo
+	defer func() { udpEcho = nil }()
+
+	req := httptest.NewRequest(http.MethodPost, "/udp", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	w := httptest.NewRecorder()
+	udpHandshake(w, req)
+	var sess udpSessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &sess); err != nil {
+		t.Fatalf("decoding session %q: %v", w.Body.String(), err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(sess.Port)))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	token, _ := hex.DecodeString(sess.Session)
+	probe := make([]byte, 64)
+	copy(probe, token)
+	binary.BigEndian.PutUint32(probe[udpTokenSize:], 7)
+	binary.BigEndian.PutUint64(probe[udpTokenSize+4:], uint64(time.Now().UnixNano()))
+	if _, err := conn.Write(probe); err != nil {
+		t.Fatalf("write probe: %v", err)
+	}
+	reply := make([]byte, udpMaxProbeSize)
+	n, err := conn.Read(reply)
+	if err != nil || n != len(probe) {
+		t.Fatalf("read echo: %d bytes, %v", n, err)
+	}
+	if binary.BigEndian.Uint32(reply[udpTokenSize:]) != 7 || binary.BigEndian.Uint64(reply[udpTokenSize+12:]) == 0 {
+		t.Errorf("unexpected echo %x", reply[:n])
+	}
+
+	w = httptest.NewRecorder()
+	udpHandshake(w, httptest.NewRequest(http.MethodGet, "/udp?sent=2&session="+sess.Session, nil))
+	var stats udpStatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decoding stats %q: %v", w.Body.String(), err)
+	}
+	if stats.Upstream.Received != 1 || stats.Upstream.Lost != 1 {
+		t.Errorf("upstream stats = %+v", stats.Upstream)
+	}
+
+	// the session above counts towards the per IP limit
+	for i := 1; i < udpMaxSessionsPerIP; i++ {
+		w = httptest.NewRecorder()
+		udpHandshake(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("session %d: %d", i, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	udpHandshake(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("session over the limit: %d", w.Code)
+	}
+}
+
+func TestWebTransportSessionLimit(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "/webtransport", nil)
+	ip := remoteIP(req)
+	for i := 0; i < wtMaxSessionsPerIP; i++ {
+		if !wtSessions.acquire(ip) {
+			t.Fatalf("session %d refused", i)
+		}
+	}
+	w := httptest.NewRecorder()
+	datagramTest(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("session over the limit: %d", w.Code)
+	}
+
+	wtSessions.release(ip)
+	// admitted, but not a valid WebTransport request
+	w = httptest.NewRecorder()
+	datagramTest(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("session under the limit: %d", w.Code)
+	}
+	for i := 1; i < wtMaxSessionsPerIP; i++ {
+		wtSessions.release(ip)
+	}
+	if n := len(wtSessions.perIP); n != 0 {
+		t.Errorf("%d clients left after release", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	l := newRateLimiter(&config.Config{
+		RateLimitRequests:   1,
+		RateLimitBurst:      2,
+		RateLimitStreams:    1,
+		RateLimitIPv4Prefix: 24,
+		RateLimitIPv6Prefix: 64,
+	})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			close(started)
+			<-release
+		}
+	}))
+	get := func(addr, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/garbage?"+query, nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// a running stream blocks further ones from the same subnet
+	done := make(chan struct{})
+	go func() {
+		get("192.0.2.1:1000", "block=1")
+		close(done)
+	}()
+	<-started
+	if w := get("192.0.2.2:1000", ""); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("second stream: code %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := get("198.51.100.1:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("other subnet: code %d", w.Code)
+	}
+	close(release)
+	<-done
+
+	// the blocking request took one of the 2 tokens, the rejected stream none
+	if w := get("192.0.2.1:1000", ""); w.Code != http.StatusOK {
+		t.Errorf("within burst: code %d", w.Code)
+	}
+	w := get("192.0.2.1:1000", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("over rate: code %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if got := l.key("2001:db8:1:2:3::4"); got != "2001:db8:1:2::/64" {
+		t.Errorf("IPv6 key = %q", got)
+	}
+	if newRateLimiter(&config.Config{}) != nil {
+		t.Error("rate limiter created without limits")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	store, _ := memory.Open(schema.Config{})
+	today := quotaDay(time.Now())
+	_ = store.AddQuotaUsage([]schema.QuotaUsage{{Day: today, IPAddress: "192.0.2.1", Egress: chunkSize}})
+
+	q, err := newQuotaTracker(&config.Config{
+		QuotaDownloadPerIP:  "3MB",
+		QuotaUpload:         "2KB",
+		RateLimitIPv4Prefix: 32,
+		RateLimitIPv6Prefix: 64,
+	}, store)
+	if err != nil {
+		t.Fatalf("newQuotaTracker: %v", err)
+	}
+	quotas = q
+	defer func() { quotas = nil }()
+
+	download := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/garbage?ckSize=4", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		garbage(w, req)
+		return w
+	}
+	// 1 MB of the quota was used before the restart
+	if w := download("192.0.2.1:1000"); w.Code != http.StatusOK || w.Body.Len() != 2*chunkSize {
+		t.Errorf("download within quota: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := download("192.0.2.1:1000"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("download over quota: code %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := download("192.0.2.2:1000"); w.Code != http.StatusOK || w.Body.Len() != 3*chunkSize {
+		t.Errorf("download of another client: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	// IPv6 clients share the quota of their /64
+	if w := download("[2001:db8::1]:1000"); w.Code != http.StatusOK || w.Body.Len() != 3*chunkSize {
+		t.Errorf("IPv6 download within quota: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := download("[2001:db8::2]:1000"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("IPv6 download of the same subnet: code %d", w.Code)
+	}
+	// duration bounded downloads reserve their quota as they go, and stop once it is used up
+	req := httptest.NewRequest(http.MethodGet, "/garbage?duration=5s", nil)
+	req.RemoteAddr = "192.0.2.3:1000"
+	w := httptest.NewRecorder()
+	garbage(w, req)
+	if w.Code != http.StatusOK || w.Body.Len() != 3*chunkSize || w.Header().Get(bytesSentTrailer) != strconv.Itoa(3*chunkSize) {
+		t.Errorf("duration bounded download: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	m := q.meter("192.0.2.4", session.Download)
+	if m.allow(1) != 1 || q.clients["192.0.2.4"].reserved[session.Download] != min(quotaIncrement, 3*chunkSize) {
+		t.Errorf("meter reserved %d bytes", q.clients["192.0.2.4"].reserved[session.Download])
+	}
+	m.add(1)
+	m.finish()
+	if c := q.clients["192.0.2.4"]; c.reserved[session.Download] != 0 || c.used[session.Download] != 1 {
+		t.Errorf("after finishing the meter: %+v", c)
+	}
+
+	upload := func(size int) int {
+		w := httptest.NewRecorder()
+		empty(w, httptest.NewRequest(http.MethodPost, "/empty", strings.NewReader(strings.Repeat("x", size))))
+		return w.Code
+	}
+	if code := upload(1024); code != http.StatusOK {
+		t.Errorf("upload within global quota: %d", code)
+	}
+	if code := upload(1536); code != http.StatusTooManyRequests {
+		t.Errorf("upload over global quota: %d", code)
+	}
+	// without a known length, the upload is cut off at the quota
+	req = httptest.NewRequest(http.MethodPost, "/empty", strings.NewReader(strings.Repeat("x", 1536)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	empty(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("upload of unknown length over global quota: %d", w.Code)
+	}
+
+	q.flush()
+	usage, _ := store.FetchQuotaUsage(today)
+	got := make(map[string]schema.QuotaUsage)
+	for _, u := range usage {
+		got[u.IPAddress] = u
+	}
+	if got[""].Egress != 11*chunkSize+1 || got[""].Ingress != 2048 || got["192.0.2.1"].Egress != 3*chunkSize ||
+		got["2001:db8::/64"].Egress != 3*chunkSize {
+		t.Errorf("stored usage = %+v", got)
+	}
+}
+
+func TestShaping(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want linkProfile
+		err  bool
+	}{
+		{"10M@30ms", linkProfile{rate: 10e6, latency: 30 * time.Millisecond}, false},
+		{"512kbit", linkProfile{rate: 512e3}, false},
+		{"@100", linkProfile{latency: 100 * time.Millisecond}, false},
+		{"1.5G@1s", linkProfile{rate: 1.5e9, latency: time.Second}, false},
+		{"fast", linkProfile{}, true},
+		{"0", linkProfile{}, true},
+		{"10M@1h", linkProfile{}, true},
+	} {
+		got, err := parseLinkProfile(tc.in)
+		if (err != nil) != tc.err || (!tc.err && got != tc.want) {
+			t.Errorf("parseLinkProfile(%q) = %+v, %v", tc.in, got, err)
+		}
+	}
+
+	conf := config.LoadedConfig()
+	conf.EnableShaping = true
+	conf.ShapingProfiles = map[string]string{"dsl": "8M@50ms"}
+	defer func() { conf.EnableShaping, conf.ShapingProfiles = false, nil }()
+
+	download := shaping(http.HandlerFunc(garbage))
+	start := time.Now()
+	w := httptest.NewRecorder()
+	download.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/garbage?ckSize=1&chunkSize=200KB&profile=dsl", nil))
+	// 200 KB at 1 MB/s, of which the first 10 KB burst is free, plus 50ms
+	if elapsed := time.Since(start); w.Code != http.StatusOK || w.Body.Len() != 200<<10 || elapsed < 200*time.Millisecond {
+		t.Errorf("shaped download: code %d, %d bytes in %s", w.Code, w.Body.Len(), elapsed)
+	}
+
+	upload := shaping(http.HandlerFunc(empty))
+	start = time.Now()
+	w = httptest.NewRecorder()
+	upload.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/empty?rate=4M", bytes.NewReader(make([]byte, 100<<10))))
+	if elapsed := time.Since(start); w.Code != http.StatusOK || elapsed < 180*time.Millisecond {
+		t.Errorf("shaped upload: code %d in %s", w.Code, elapsed)
+	}
+
+	// concurrent streams of a client share the link: 100 KB at 250 KB/s
+	var wg sync.WaitGroup
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/garbage?ckSize=1&chunkSize=50KB&rate=2M", nil)
+			req.RemoteAddr = "192.0.2.9:1000"
+			download.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("two shaped streams took %s", elapsed)
+	}
+
+	for _, query := range []string{"profile=satellite", "rate=fast", "latency=-1"} {
+		w = httptest.NewRecorder()
+		download.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/garbage?ckSize=0&"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: code %d", query, w.Code)
+		}
+	}
+}
+
+func TestTestAdmission(t *testing.T) {
+	a := newTestAdmission(&config.Config{MaxConcurrentTests: 1, TestIdleTimeout: 10 * time.Second})
+	t0 := time.Now()
+
+	if s := a.admit("192.0.2.1", t0, true); s.Busy {
+		t.Fatalf("first client busy: %+v", s)
+	}
+	b := a.admit("192.0.2.2", t0, false)
+	c := a.admit("192.0.2.3", t0, false)
+	if !b.Busy || b.Position != 1 || !c.Busy || c.Position != 2 || c.EstimatedWait <= b.EstimatedWait {
+		t.Fatalf("queued clients: %+v, %+v", b, c)
+	}
+
+	// the slot is held while a request is running, and for test_idle_timeout afterwards
+	if s := a.admit("192.0.2.2", t0.Add(time.Minute), false); !s.Busy {
+		t.Fatalf("admitted while a request is running: %+v", s)
+	}
+	a.release("192.0.2.1")
+	if s := a.admit("192.0.2.2", t0.Add(5*time.Second), false); !s.Busy {
+		t.Fatalf("admitted before the slot went idle: %+v", s)
+	}
+	now := time.Now().Add(11 * time.Second)
+	// the free slot is kept for the client queued first
+	if s := a.admit("192.0.2.3", now, false); !s.Busy || s.Position != 1 || s.EstimatedWait <= 0 {
+		t.Fatalf("skipped the queue: %+v", s)
+	}
+	if s := a.admit("192.0.2.2", now, true); s.Busy {
+		t.Fatalf("not admitted after the slot went idle: %+v", s)
+	}
+
+	// waiting clients that stop polling lose their place
+	if s := a.admit("192.0.2.4", now.Add(time.Second), false); s.Position != 2 {
+		t.Fatalf("new client: %+v", s)
+	}
+	if s := a.admit("192.0.2.4", now.Add(time.Second+queueEntryTimeout), false); s.Position != 1 {
+		t.Fatalf("queue kept an abandoned entry: %+v", s)
+	}
+
+	busy := newTestAdmission(&config.Config{MaxConcurrentTests: 1, TestIdleTimeout: time.Minute})
+	busy.admit("198.51.100.1", time.Now(), false)
+	w := httptest.NewRecorder()
+	busy.Handler(http.HandlerFunc(garbage)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/garbage", nil))
+	var got busyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusServiceUnavailable ||
+		!got.Busy || got.Position != 1 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("busy response: %d %q, %v", w.Code, w.Body.String(), err)
+	}
+
+	// the queue is capped, clients beyond it aren't queued
+	for i := len(busy.queue); i < maxQueueLength; i++ {
+		busy.admit(fmt.Sprintf("10.0.%d.%d", i/256, i%256), time.Now(), false)
+	}
+	if s := busy.admit("198.51.100.2", time.Now(), false); !s.Busy || len(busy.queue) != maxQueueLength || busy.queued["198.51.100.2"] != nil {
+		t.Fatalf("full queue: %+v, %d queued", s, len(busy.queue))
+	}
+	if e := busy.queued["10.0.0.5"]; e == nil || busy.queue[e.index] != e {
+		t.Fatalf("queue index: %+v", e)
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	pow.Initialize(&config.Config{PowDifficulty: 4})
+	powThreshold = 2 * chunkSize
+	defer func() {
+		pow.Initialize(&config.Config{})
+		powThreshold = 0
+		powBudgets = &powBudgetTracker{clients: make(map[string]*powBudget)}
+	}()
+
+	download := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		garbage(w, httptest.NewRequest(http.MethodGet, "/garbage?"+query, nil))
+		return w
+	}
+	if w := download("ckSize=3"); w.Code != http.StatusForbidden {
+		t.Fatalf("download above threshold without solution: code %d", w.Code)
+	}
+	if w := download("ckSize=2"); w.Code != http.StatusOK || w.Body.Len() != 2*chunkSize {
+		t.Fatalf("download below threshold: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	// the threshold applies to everything the client downloaded since its last solution
+	if w := download("ckSize=1"); w.Code != http.StatusForbidden {
+		t.Fatalf("download beyond the budget without solution: code %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	powChallenge(w, httptest.NewRequest(http.MethodGet, "/pow/challenge", nil))
+	var c pow.Challenge
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil || c.Difficulty != 4 {
+		t.Fatalf("challenge: %q, %v", w.Body.String(), err)
+	}
+	query := "ckSize=3&pow=" + c.Challenge + "&powSolution=" + pow.Solve(c.Challenge, c.Difficulty)
+	if w := download(query); w.Code != http.StatusOK || w.Body.Len() != 3*chunkSize {
+		t.Fatalf("download with solution: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := download(query); w.Code != http.StatusForbidden {
+		t.Fatalf("reused solution: code %d", w.Code)
+	}
+	if w := download("duration=1s"); w.Code != http.StatusForbidden {
+		t.Fatalf("duration bounded download without solution: code %d", w.Code)
+	}
+
+	// duration bounded downloads of another client run until its budget is used up
+	req := httptest.NewRequest(http.MethodGet, "/garbage?duration=5s", nil)
+	req.RemoteAddr = "198.51.100.1:1000"
+	w = httptest.NewRecorder()
+	garbage(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(bytesSentTrailer) != strconv.Itoa(2*chunkSize) {
+		t.Fatalf("duration bounded download within the budget: code %d, %s bytes", w.Code, w.Header().Get(bytesSentTrailer))
+	}
+
+	// concurrent downloads reserve their bytes, so they can't spend the same budget twice
+	concurrent := func(addr, query string) (ok int, sent int) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodGet, "/garbage?"+query, nil)
+				req.RemoteAddr = addr
+				w := httptest.NewRecorder()
+				garbage(w, req)
+				mu.Lock()
+				defer mu.Unlock()
+				if w.Code == http.StatusOK {
+					ok++
+					sent += w.Body.Len()
+				}
+			}()
+		}
+		wg.Wait()
+		return ok, sent
+	}
+	if ok, sent := concurrent("198.51.100.2:1000", "ckSize=2"); ok != 1 || sent != 2*chunkSize {
+		t.Fatalf("concurrent downloads: %d succeeded, %d bytes", ok, sent)
+	}
+	if _, sent := concurrent("198.51.100.3:1000", "duration=5s"); sent != 2*chunkSize {
+		t.Fatalf("concurrent duration bounded downloads: %d bytes", sent)
+	}
+	// a new solution adds to what is left of the budget
+	req = httptest.NewRequest(http.MethodGet, "/pow/challenge", nil)
+	req.RemoteAddr = "198.51.100.2:1000"
+	w = httptest.NewRecorder()
+	powChallenge(w, req)
+	_ = json.Unmarshal(w.Body.Bytes(), &c)
+	query = "ckSize=1&pow=" + c.Challenge + "&powSolution=" + pow.Solve(c.Challenge, c.Difficulty)
+	if ok, sent := concurrent("198.51.100.2:1000", query); ok != 1 || sent != chunkSize {
+		t.Fatalf("concurrent downloads with one solution: %d succeeded, %d bytes", ok, sent)
+	}
+	if ok, sent := concurrent("198.51.100.2:1000", "ckSize=1"); ok != 1 || sent != chunkSize {
+		t.Fatalf("concurrent downloads with the rest of the budget: %d succeeded, %d bytes", ok, sent)
+	}
+
+	// test files count against the same budget
+	files, _ := newTestFiles([]string{"64KB"})
+	testFiles = files
+	defer func() { testFiles = nil }()
+	r := chi.NewRouter()
+	r.Get("/files/{name}", testFileHandler)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/64KB.bin", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("test file beyond the budget without solution: code %d", w.Code)
+	}
+	// ranges are charged for what they request, not the whole file
+	get := func(name, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+name, nil)
+		req.RemoteAddr = "203.0.113.1:1000"
+		req.Header.Set("Range", rng)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	files, _ = newTestFiles([]string{"4MB"})
+	testFiles = files
+	if w := get("4MB.bin", "bytes=-1024"); w.Code != http.StatusPartialContent || w.Body.Len() != 1024 {
+		t.Fatalf("range within the budget: code %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := get("4MB.bin", "bytes=1024-"); w.Code != http.StatusForbidden {
+		t.Fatalf("range beyond the budget: code %d", w.Code)
+	}
+	f := files["4MB.bin"]
+	for rng, want := range map[string]int64{
+		"":                 4 << 20,
+		"bytes=0-99":       100,
+		"bytes=100-":       4<<20 - 100,
+		"bytes=-100":       100,
+		"bytes=0-9, 20-29": 20,
+		"bytes=0-99999999": 4 << 20,
+		"bytes=x-1":        4 << 20,
+		"items=0-1":        4 << 20,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/files/4MB.bin", nil)
+		req.Header.Set("Range", rng)
+		if got := requestedLength(req, f); got != want {
+			t.Errorf("Range %q: %d bytes, want %d", rng, got, want)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = remoteIP(r) })
+
+	for _, tc := range []struct {
+		realIPHeader string
+		peer         string
+		header       http.Header
+		want         string
+	}{
+		{"X-Real-IP", "192.0.2.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "192.0.2.1"},
+		{"", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"X-Real-IP", "10.1.2.3:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"", "10.1.2.3:1234", nil, "10.1.2.3"},
+		{"", "[::1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		// spoofed hops left of the client's address are ignored
+		{"", "10.1.2.3:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1", "10.4.4.4"}}, "198.51.100.1"},
+		{"", "10.1.2.3:1234", http.Header{"X-Forwarded-For": {"10.5.5.5, 10.4.4.4"}}, "10.5.5.5"},
+		{"X-Real-IP", "10.1.2.3:1234", http.Header{"X-Real-Ip": {"not an address"}}, "10.1.2.3"},
+		// a proxy that only appends to X-Forwarded-For passes on the client's own X-Real-IP
+		{"", "10.1.2.3:1234", http.Header{"X-Real-Ip": {"203.0.113.9"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"", "10.1.2.3:1234", http.Header{"X-Real-Ip": {"203.0.113.9"}}, "10.1.2.3"},
+	} {
+		h := proxies.realIP(tc.realIPHeader)(next)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.peer
+		req.Header = tc.header
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tc.want {
+			t.Errorf("peer %s, %v: client %s, want %s", tc.peer, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestHTTP3Server(t *testing.T) {
+	marker := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})
+
+	h3, h, err := newHTTP3Server(&config.Config{Port: "8080"}, marker)
+	if err != nil || h3 != nil {
+		t.Fatalf("disabled: %v, %v", h3, err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if v := rec.Header().Get("Alt-Svc"); v != "" {
+		t.Fatalf("Alt-Svc sent without HTTP/3: %q", v)
+	}
+	if _, _, err := newHTTP3Server(&config.Config{EnableHTTP3: true}, marker); err == nil {
+		t.Fatal("HTTP/3 enabled without TLS")
+	}
+
+	// find a free UDP port for the HTTP/3 listener
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+	_ = pc.Close()
+
+	conf := &config.Config{BindAddress: "127.0.0.1", Port: "8080", HTTP3Port: port, EnableTLS: true, EnableHTTP3: true}
+	h3, h, err = newHTTP3Server(conf, marker)
+	if err != nil || h3 == nil {
+		t.Fatalf("enabled: %v, %v", h3, err)
+	}
+	if h3.Addr != "127.0.0.1:"+port {
+		t.Fatalf("HTTP/3 address = %s", h3.Addr)
+	}
+	cert := selfSignedCert(t)
+	h3.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() { _ = h3.ListenAndServe() }()
+	defer h3.Close()
+
+	want := `h3=":` + port + `"`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if strings.HasPrefix(rec.Header().Get("Alt-Svc"), want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Alt-Svc = %q, want %s", rec.Header().Get("Alt-Svc"), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.Body.String() != "HTTP/1.1" {
+		t.Fatalf("TCP response = %q", rec.Body.String())
+	}
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	resp, err := (&http.Client{Transport: tr}).Get("https://" + h3.Addr + "/")
+	if err != nil {
+		t.Fatalf("HTTP/3 get: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "HTTP/3.0" {
+		t.Fatalf("HTTP/3 response = %q", b)
+	}
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/librespeed/speedtest/config"
+	"github.com/librespeed/speedtest/session"
+)
+
+const (
+	// limit for JSON control messages sent by the client
+	wsMaxControlSize = 4096
+	// how long clients may stay silent if test_idle_timeout isn't set
+	wsDefaultIdleTimeout = 10 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	// CORS is open for every other endpoint as well
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a control message sent by the client as a text frame.
+//
+// Supported actions:
+//   - "ping": the server answers immediately with a "pong" carrying the same ID
+//   - "download": the server sends Chunks binary frames of random data, then a "download" summary
+//   - "upload": resets the upload counter; every following binary frame is acknowledged
+//     with an "upload" message carrying the total bytes received so far
+type wsRequest struct {
+	Action string `json:"action"`
+	ID     int64  `json:"id,omitempty"`
+	Chunks int    `json:"chunks,omitempty"`
+}
+
+type wsResponse struct {
+	Type       string `json:"type"`
+	ID         int64  `json:"id,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	ServerTime int64  `json:"serverTime,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// websocketTest runs download, upload and ping over a single long-lived connection
+func websocketTest(w http.ResponseWriter, r *http.Request) {
+	// a challenge solution is passed when connecting, downloads are charged as they are requested
+	pm, ok := requirePoW(w, r, 0)
+	if !ok {
+		return
+	}
+	defer pm.finish()
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("upgrading websocket connection", slog.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	ip := remoteIP(r)
+	up := quotas.meter(ip, session.Upload)
+	defer up.finish()
+	var (
+		uploaded    int64
+		uploadStart = time.Now()
+	)
+
+	// idle connections are closed, they would hold their test slot and rate limit stream
+	idle := config.LoadedConfig().TestIdleTimeout
+	if idle <= 0 {
+		idle = wsDefaultIdleTimeout
+	}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idle))
+		msgType, reader, err := conn.NextReader()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Debug("reading websocket message", slog.Any("error", err))
+			}
+			return
+		}
+
+		if msgType == websocket.BinaryMessage {
+			n, err := io.Copy(io.Discard, quotaReader{r: reader, m: up})
+			uploaded += n
+			if errors.Is(err, errQuotaExceeded) {
+				_ = conn.WriteJSON(wsResponse{Type: "error", Error: err.Error()})
+				return
+			}
+			if err != nil {
+				slog.Debug("reading websocket upload frame", slog.Any("error", err))
+				return
+			}
+			if err := conn.WriteJSON(wsResponse{
+				Type:       "upload",
+				Bytes:      uploaded,
+				DurationMs: time.Since(uploadStart).Milliseconds(),
+			}); err != nil {
+				return
+			}
+			continue
+		}
+
+		var req wsRequest
+		if err := json.NewDecoder(io.LimitReader(reader, wsMaxControlSize)).Decode(&req); err != nil {
+			if err := conn.WriteJSON(wsResponse{Type: "error", Error: "invalid request"}); err != nil {
+				return
+			}
+			continue
+		}
+
+		switch req.Action {
+		case "ping":
+			err = conn.WriteJSON(wsResponse{
+				Type:       "pong",
+				ID:         req.ID,
+				ServerTime: time.Now().UnixMilli(),
+			})
+		case "download":
+			err = wsDownload(conn, ip, pm, req.Chunks)
+		case "upload":
+			uploaded = 0
+			uploadStart = time.Now()
+			err = conn.WriteJSON(wsResponse{Type: "upload"})
+		default:
+			err = conn.WriteJSON(wsResponse{Type: "error", Error: "unknown action"})
+		}
+		if err != nil {
+			if !errors.Is(err, websocket.ErrCloseSent) {
+				slog.Debug("writing websocket message", slog.Any("error", err))
+			}
+			return
+		}
+	}
+}
+
+func wsDownload(conn *websocket.Conn, ip string, pm *powMeter, chunks int) error {
+	if chunks <= 0 {
+		chunks = 4
+	}
+	// same limits as garbage
+	if maxChunks := int(min(maxDownloadSize/int64(len(randomData)), math.MaxInt32)); chunks > maxChunks {
+		chunks = maxChunks
+	}
+	size := int64(len(randomData))
+	if chunks = int(pm.allow(int64(chunks)*size) / size); chunks == 0 {
+		return conn.WriteJSON(wsResponse{Type: "error", Error: errPoWRequired.Error()})
+	}
+	granted := quotas.reserve(ip, session.Download, int64(chunks)*size)
+	var sent int64
+	defer func() {
+		quotas.finish(ip, session.Download, granted, sent)
+		pm.add(sent)
+	}()
+	if chunks = int(granted / size); chunks == 0 {
+		return conn.WriteJSON(wsResponse{Type: "error", Error: errQuotaExceeded.Error()})
+	}
+
+	start := time.Now()
+	for i := 0; i < chunks; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, randomData); err != nil {
+			return err
+		}
+		sent += int64(len(randomData))
+	}
+
+	return conn.WriteJSON(wsResponse{
+		Type:       "download",
+		Bytes:      sent,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+}
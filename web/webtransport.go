@@ -0,0 +1,341 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+const (
+	// sequence number and send timestamp in nanoseconds
+	datagramHeaderSize = 4 + 8
+	// stay below the smallest QUIC datagram payload size clients are guaranteed to accept
+	datagramMaxSize     = 1200
+	datagramMaxCount    = 10000
+	datagramMinInterval = time.Millisecond
+	// time to wait for in-flight datagrams after the client finished sending
+	datagramGracePeriod = time.Second
+	// limit on concurrent sessions, each one sends datagrams for up to a minute
+	wtMaxSessionsPerIP = 8
+)
+
+// wtServer is attached to the HTTP/3 server by startListener when WebTransport is enabled
+var wtServer = &webtransport.Server{
+	// CORS is open for every other endpoint as well
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wtSessions counts the live WebTransport sessions of each client
+var wtSessions = &wtSessionCounter{perIP: make(map[string]int)}
+
+type wtSessionCounter struct {
+	mu    sync.Mutex
+	perIP map[string]int
+}
+
+// acquire counts a new session for ip, or returns false if it has too many already
+func (c *wtSessionCounter) acquire(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perIP[ip] >= wtMaxSessionsPerIP {
+		return false
+	}
+	c.perIP[ip]++
+	return true
+}
+
+func (c *wtSessionCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+// datagramTestRequest is the first line the client writes on its control stream
+type datagramTestRequest struct {
+	Count      int `json:"count"`
+	IntervalMs int `json:"intervalMs"`
+	Size       int `json:"size"`
+}
+
+// datagramTestDone is the second line the client writes on its control stream,
+// once it has sent all of its datagrams
+type datagramTestDone struct {
+	Sent int `json:"sent"`
+}
+
+// datagramTestReport is written back on the control stream at the end of the test
+type datagramTestReport struct {
+	// datagrams sent by the server, the client computes downstream figures itself
+	DownstreamSent int           `json:"downstreamSent"`
+	Upstream       sequenceStats `json:"upstream"`
+}
+
+// sequenceStats describes one direction of a stream of sequenced, timestamped packets
+type sequenceStats struct {
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	Lost        int     `json:"lost"`
+	LossPercent float64 `json:"lossPercent"`
+	Reordered   int     `json:"reordered"`
+	Duplicates  int     `json:"duplicates"`
+	JitterMs    float64 `json:"jitterMs"`
+}
+
+// duplicates are detected among this many sequence numbers up to the highest one received
+const sequenceWindow = 4096
+
+// sequenceTracker accumulates sequenceStats from received packets.
+// Jitter is the RFC 3550 interarrival jitter, which doesn't depend on clock offset between the peers.
+type sequenceTracker struct {
+	mu sync.Mutex
+	// bitmap of the sequence numbers received in the window ending at highest
+	window      [sequenceWindow / 64]uint64
+	highest     uint32
+	received    int
+	reordered   int
+	duplicates  int
+	jitter      float64
+	lastTransit time.Duration
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{}
+}
+
+func (t *sequenceTracker) add(seq uint32, sent, arrived time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.received == 0:
+		t.mark(seq)
+	case seq > t.highest:
+		t.slide(seq)
+		t.mark(seq)
+	case t.highest-seq >= sequenceWindow:
+		// too old to tell whether it is a duplicate, it counts as reordered
+	case t.marked(seq):
+		t.duplicates++
+		return
+	default:
+		t.mark(seq)
+	}
+
+	transit := arrived.Sub(sent)
+	if t.received > 0 {
+		if seq < t.highest {
+			t.reordered++
+		}
+		d := transit - t.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		t.jitter += (float64(d) - t.jitter) / 16
+	}
+	if seq > t.highest || t.received == 0 {
+		t.highest = seq
+	}
+	t.lastTransit = transit
+	t.received++
+}
+
+func (t *sequenceTracker) mark(seq uint32) {
+	i := seq % sequenceWindow
+	t.window[i/64] |= 1 << (i % 64)
+}
+
+func (t *sequenceTracker) marked(seq uint32) bool {
+	i := seq % sequenceWindow
+	return t.window[i/64]&(1<<(i%64)) != 0
+}
+
+// slide moves the window up to end at seq, forgetting the sequence numbers that fall out of it
+func (t *sequenceTracker) slide(seq uint32) {
+	if seq-t.highest >= sequenceWindow {
+		t.window = [sequenceWindow / 64]uint64{}
+		return
+	}
+	for s := t.highest + 1; s != seq+1; s++ {
+		i := s % sequenceWindow
+		t.window[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// stats returns the statistics given the number of packets the peer says it has sent
+func (t *sequenceTracker) stats(sent int) sequenceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ret := sequenceStats{
+		Sent:       sent,
+		Received:   t.received,
+		Reordered:  t.reordered,
+		Duplicates: t.duplicates,
+		JitterMs:   t.jitter / float64(time.Millisecond),
+	}
+	if sent > t.received {
+		ret.Lost = sent - t.received
+	}
+	if sent > 0 {
+		ret.LossPercent = float64(ret.Lost) * 100 / float64(sent)
+	}
+	return ret
+}
+
+func putSequenceHeader(b []byte, seq uint32, t time.Time) {
+	binary.BigEndian.PutUint32(b, seq)
+	binary.BigEndian.PutUint64(b[4:], uint64(t.UnixNano()))
+}
+
+func parseSequenceHeader(b []byte) (uint32, time.Time, bool) {
+	if len(b) < datagramHeaderSize {
+		return 0, time.Time{}, false
+	}
+	return binary.BigEndian.Uint32(b), time.Unix(0, int64(binary.BigEndian.Uint64(b[4:]))), true
+}
+
+// datagramTest measures one-way loss, reordering and jitter with unreliable WebTransport datagrams.
+//
+// The client opens a bidirectional stream and writes a datagramTestRequest as a JSON line.
+// Both sides then send Count datagrams, each starting with a big endian uint32 sequence number
+// and the big endian uint64 send time in Unix nanoseconds. When the client is done sending,
+// it writes a datagramTestDone line, and the server answers with a datagramTestReport.
+func datagramTest(w http.ResponseWriter, r *http.Request) {
+	ip := remoteIP(r)
+	if !wtSessions.acquire(ip) {
+		slog.Debug("Too many WebTransport sessions", slog.String("ip", ip))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer wtSessions.release(ip)
+
+	sess, err := wtServer.Upgrade(w, r)
+	if err != nil {
+		slog.Error("upgrading WebTransport session", slog.Any("error", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer sess.CloseWithError(0, "")
+
+	ctx, cancel := context.WithTimeout(sess.Context(), time.Minute)
+	defer cancel()
+
+	str, err := sess.AcceptStream(ctx)
+	if err != nil {
+		slog.Debug("accepting WebTransport control stream", slog.Any("error", err))
+		return
+	}
+	defer str.Close()
+	// reads on the stream don't observe ctx, an idle client would hold the session forever
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = str.SetReadDeadline(deadline)
+	}
+
+	lines := bufio.NewScanner(str)
+	var req datagramTestRequest
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &req) != nil {
+		slog.Debug("invalid datagram test request")
+		return
+	}
+	req.normalize()
+
+	tracker := newSequenceTracker()
+	go func() {
+		for {
+			b, err := sess.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			if seq, sent, ok := parseSequenceHeader(b); ok {
+				tracker.add(seq, sent, time.Now())
+			}
+		}
+	}()
+
+	sentCh := make(chan int, 1)
+	go func() {
+		sentCh <- sendSequencedDatagrams(ctx, sess, req)
+	}()
+
+	var done datagramTestDone
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &done) != nil {
+		slog.Debug("datagram test aborted by client")
+		return
+	}
+
+	select {
+	case <-time.After(datagramGracePeriod):
+	case <-ctx.Done():
+		return
+	}
+	// stop sending if the client finished before us
+	cancel()
+
+	report := datagramTestReport{
+		DownstreamSent: <-sentCh,
+		Upstream:       tracker.stats(done.Sent),
+	}
+	if err := json.NewEncoder(str).Encode(report); err != nil {
+		slog.Debug("writing datagram test report", slog.Any("error", err))
+		return
+	}
+	_ = str.Close()
+
+	// closing the session right away could discard the report before it's delivered
+	select {
+	case <-sess.Context().Done():
+	case <-time.After(datagramGracePeriod * 5):
+	}
+}
+
+func (req *datagramTestRequest) normalize() {
+	if req.Count <= 0 {
+		req.Count = 100
+	}
+	if req.Count > datagramMaxCount {
+		req.Count = datagramMaxCount
+	}
+	if req.IntervalMs < int(datagramMinInterval/time.Millisecond) {
+		req.IntervalMs = int(datagramMinInterval / time.Millisecond)
+	}
+	if req.Size < datagramHeaderSize {
+		req.Size = datagramHeaderSize
+	}
+	if req.Size > datagramMaxSize {
+		req.Size = datagramMaxSize
+	}
+}
+
+// sendSequencedDatagrams sends the requested datagrams and returns how many were sent
+func sendSequencedDatagrams(ctx context.Context, sess *webtransport.Session, req datagramTestRequest) int {
+	ticker := time.NewTicker(time.Duration(req.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	sent := 0
+	for seq := 0; seq < req.Count; seq++ {
+		b := make([]byte, req.Size)
+		copy(b[datagramHeaderSize:], randomData)
+		putSequenceHeader(b, uint32(seq), time.Now())
+		if err := sess.SendDatagram(b); err != nil {
+			slog.Debug("sending datagram", slog.Any("error", err))
+			return sent
+		}
+		sent++
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return sent
+		}
+	}
+	return sent
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+const (
+	// read buffer size for draining uploads
+	drainBufferSize = 256 * 1024
+)
+
+var drainBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, drainBufferSize)
+		return &b
+	},
+}
+
+// drainBody reads r until EOF using large pooled buffers and returns the number of bytes read.
+// io.Copy(io.Discard, r) would use io.Discard's own 8 KiB buffers instead.
+// If h isn't nil, everything read is written to it as well.
+func drainBody(r io.Reader, h hash.Hash) (int64, error) {
+	buf := drainBuffers.Get().(*[]byte)
+	defer drainBuffers.Put(buf)
+
+	var total int64
+	for {
+		n, err := r.Read(*buf)
+		total += int64(n)
+		if h != nil {
+			h.Write((*buf)[:n])
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// writeChunks writes the given number of chunks from payload to w using plain writes
+func writeChunks(w io.Writer, payload payloadFunc, chunks int) int64 {
+	var sent int64
+	for i := 0; i < chunks; i++ {
+		n, err := w.Write(payload())
+		sent += int64(n)
+		if err != nil {
+			slog.Error("Error writing back to client",
+				slog.Any("chunk number", i),
+				slog.Any("error", err),
+			)
+
+			break
+		}
+	}
+	return sent
+}
+
+// writeStaticChunks writes the given number of chunks of the first size bytes of randomData
+// to w, using sendfile where the platform and the underlying connection support it
+func writeStaticChunks(w http.ResponseWriter, chunks, size int) int64 {
+	if sent, ok := sendStaticChunks(w, chunks, size); ok {
+		return sent
+	}
+	return writeChunks(w, func() []byte { return randomData[:size] }, chunks)
+}
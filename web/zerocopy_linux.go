@@ -0,0 +1,69 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// staticDataFile is a memfd holding randomData, so it can be handed to sendfile
+var staticDataFile = sync.OnceValues(func() (*os.File, error) {
+	fd, err := unix.MemfdCreate("librespeed-garbage", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("creating memfd: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "librespeed-garbage")
+	if _, err := f.Write(randomData); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("writing random data to memfd: %w", err)
+	}
+	return f, nil
+})
+
+// sendStaticChunks copies the first size bytes of randomData from a memfd straight into the socket with sendfile.
+// It returns false without writing anything if the zero-copy path is not available,
+// e.g. for TLS or HTTP/2 connections that don't implement io.ReaderFrom.
+func sendStaticChunks(w http.ResponseWriter, chunks, size int) (int64, bool) {
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return 0, false
+	}
+	src, err := staticDataFile()
+	if err != nil {
+		slog.Warn("Zero-copy download unavailable", slog.Any("error", err))
+		return 0, false
+	}
+
+	// reopen the memfd so every request gets its own file offset
+	f, err := os.Open(fmt.Sprintf("/proc/self/fd/%d", src.Fd()))
+	if err != nil {
+		slog.Warn("Zero-copy download unavailable", slog.Any("error", err))
+		return 0, false
+	}
+	defer f.Close()
+
+	var sent int64
+	for i := 0; i < chunks; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			slog.Error("Error rewinding memfd", slog.Any("error", err))
+			break
+		}
+		// net.TCPConn still uses sendfile for a LimitedReader wrapping a file
+		n, err := rf.ReadFrom(&io.LimitedReader{R: f, N: int64(size)})
+		sent += n
+		if err != nil {
+			slog.Error("Error writing back to client",
+				slog.Any("chunk number", i),
+				slog.Any("error", err),
+			)
+
+			break
+		}
+	}
+	return sent, true
+}
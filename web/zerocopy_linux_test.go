@@ -0,0 +1,98 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSendStaticChunks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(garbage))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/garbage?ckSize=3")
+	if err != nil {
+		t.Fatalf("GET garbage: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if len(b) != 3*chunkSize {
+		t.Fatalf("got %d bytes, want %d", len(b), 3*chunkSize)
+	}
+	for i := 0; i < 3; i++ {
+		if !bytes.Equal(b[i*chunkSize:(i+1)*chunkSize], randomData) {
+			t.Fatalf("chunk %d differs from randomData", i)
+		}
+	}
+}
+
+// BenchmarkGarbageTransfer compares the w.Write(randomData) loop with the sendfile path over loopback TCP
+func BenchmarkGarbageTransfer(b *testing.B) {
+	const chunks = 64
+
+	handlers := map[string]http.HandlerFunc{
+		"write": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(chunks*chunkSize))
+			writeChunks(w, staticPayload, chunks)
+		},
+		"sendfile": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(chunks*chunkSize))
+			writeStaticChunks(w, chunks, chunkSize)
+		},
+	}
+
+	for _, name := range []string{"write", "sendfile"} {
+		b.Run(name, func(b *testing.B) {
+			srv := httptest.NewServer(handlers[name])
+			defer srv.Close()
+
+			b.SetBytes(chunks * chunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkEmptyTransfer compares draining uploads with io.Discard and with pooled buffers over loopback TCP
+func BenchmarkEmptyTransfer(b *testing.B) {
+	data := make([]byte, 64*chunkSize)
+
+	handlers := map[string]http.HandlerFunc{
+		"discard": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+		},
+		"pooled": func(w http.ResponseWriter, r *http.Request) {
+			_, _ = drainBody(r.Body, nil)
+		},
+	}
+
+	for _, name := range []string{"discard", "pooled"} {
+		b.Run(name, func(b *testing.B) {
+			srv := httptest.NewServer(handlers[name])
+			defer srv.Close()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Post(srv.URL, "application/octet-stream", bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
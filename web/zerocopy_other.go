@@ -0,0 +1,11 @@
+//go:build !linux
+
+package web
+
+import (
+	"net/http"
+)
+
+func sendStaticChunks(_ http.ResponseWriter, _, _ int) (int64, bool) {
+	return 0, false
+}